@@ -4,15 +4,19 @@ package sane
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -26,7 +30,7 @@ var maxSerialNumber = big.NewInt(0).SetBytes(bytes.Repeat([]byte{255}, 20))
 // capable of MITM.
 type mitmConfig struct {
 	ca             *x509.Certificate
-	capriv         interface{}
+	capriv         crypto.Signer
 	priv           *rsa.PrivateKey
 	keyID          []byte
 	validity       time.Duration
@@ -34,13 +38,69 @@ type mitmConfig struct {
 	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 	roots          *x509.CertPool
 
+	// chain is sent after the minted leaf
+	chain [][]byte
+	// issuances if set logs every minted leaf
+	issuances *IssuanceLog
+
 	certmu sync.RWMutex
-	certs  map[string]*tls.Certificate
+	certs  map[string]*cachedCert
+}
+
+// cachedCert is a minted certificate and the fingerprint
+// of the upstream certificate it mirrors, if any.
+type cachedCert struct {
+	*tls.Certificate
+	upstream [sha256.Size]byte
 }
 
 // NewAuthority creates a new CA certificate and associated
 // private key.
 func NewAuthority(name, organization string, validity time.Duration, constraints map[string]struct{}) (*x509.Certificate, *rsa.PrivateKey, error) {
+	return NewAuthorityWithPathLen(name, organization, validity, constraints, 0)
+}
+
+// NewAuthorityWithPathLen creates a new CA certificate allowing up to maxPathLen
+// intermediate CAs below it. A CA must allow at least one to cross-sign its successor.
+func NewAuthorityWithPathLen(name, organization string, validity time.Duration, constraints map[string]struct{}, maxPathLen int) (*x509.Certificate, *rsa.PrivateKey, error) {
+	return newAuthority(name, organization, validity, maxPathLen, func(tmpl *x509.Certificate) {
+		if constraints == nil {
+			return
+		}
+		excludeIPs(tmpl)
+
+		var names []string
+		for name := range constraints {
+			names = append(names, "."+name)
+		}
+
+		tmpl.ExcludedDNSDomains = names
+	})
+}
+
+// NewPermittedAuthority creates a new CA certificate only permitted to issue
+// certificates for the given tlds and names below them.
+func NewPermittedAuthority(name, organization string, validity time.Duration, permitted []string, maxPathLen int) (*x509.Certificate, *rsa.PrivateKey, error) {
+	if len(permitted) == 0 {
+		return nil, nil, errors.New("no permitted tlds")
+	}
+
+	return newAuthority(name, organization, validity, maxPathLen, func(tmpl *x509.Certificate) {
+		excludeIPs(tmpl)
+		for _, d := range permitted {
+			tmpl.PermittedDNSDomains = append(tmpl.PermittedDNSDomains, strings.ToLower(strings.Trim(d, ".")))
+		}
+	})
+}
+
+func excludeIPs(tmpl *x509.Certificate) {
+	tmpl.PermittedDNSDomainsCritical = true
+	_, ipv4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, ipv6, _ := net.ParseCIDR("::/0")
+	tmpl.ExcludedIPRanges = []*net.IPNet{ipv4, ipv6}
+}
+
+func newAuthority(name, organization string, validity time.Duration, maxPathLen int, constrain func(*x509.Certificate)) (*x509.Certificate, *rsa.PrivateKey, error) {
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, nil, err
@@ -78,29 +138,83 @@ func NewAuthority(name, organization string, validity time.Duration, constraints
 		NotAfter:              time.Now().Add(validity),
 		DNSNames:              []string{name},
 		IsCA:                  true,
-		MaxPathLenZero:        true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
 	}
 
-	if constraints != nil {
-		tmpl.PermittedDNSDomainsCritical = true
-		_, ipv4, _ := net.ParseCIDR("0.0.0.0/0")
-		_, ipv6, _ := net.ParseCIDR("::/0")
-		tmpl.ExcludedIPRanges = []*net.IPNet{ipv4, ipv6}
+	constrain(tmpl)
 
-		var names []string
-		for name := range constraints {
-			names = append(names, "."+name)
-		}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		tmpl.ExcludedDNSDomains = names
+	// Parse certificate bytes so that we have a leaf certificate.
+	x509c, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	return x509c, priv, nil
+}
+
+// NewIntermediate creates a new intermediate CA certificate and associated
+// private key issued by root. The intermediate inherits the name constraints
+// of the root and cannot issue further CAs.
+func NewIntermediate(name, organization string, validity time.Duration, root *x509.Certificate, rootPriv crypto.Signer) (*x509.Certificate, *rsa.PrivateKey, error) {
+	if root.MaxPathLen == 0 || root.MaxPathLenZero {
+		return nil, nil, fmt.Errorf("ca `%s` does not allow intermediates", root.Subject.CommonName)
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub := priv.Public()
+
+	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := sha1.New()
+	h.Write(pkixpub)
+	keyID := h.Sum(nil)
+
+	serial, err := rand.Int(rand.Reader, maxSerialNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notAfter := time.Now().Add(validity)
+	if notAfter.After(root.NotAfter) {
+		notAfter = root.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   name,
+			Organization: []string{organization},
+		},
+		SubjectKeyId:                keyID,
+		KeyUsage:                    x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:                 []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid:       true,
+		NotBefore:                   time.Now().Add(-time.Hour),
+		NotAfter:                    notAfter,
+		IsCA:                        true,
+		MaxPathLenZero:              true,
+		PermittedDNSDomainsCritical: root.PermittedDNSDomainsCritical,
+		PermittedDNSDomains:         root.PermittedDNSDomains,
+		ExcludedDNSDomains:          root.ExcludedDNSDomains,
+		ExcludedIPRanges:            root.ExcludedIPRanges,
+	}
+
+	raw, err := createCertificate(tmpl, root, pub, rootPriv)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Parse certificate bytes so that we have a leaf certificate.
 	x509c, err := x509.ParseCertificate(raw)
 	if err != nil {
 		return nil, nil, err
@@ -109,9 +223,68 @@ func NewAuthority(name, organization string, validity time.Duration, constraints
 	return x509c, priv, nil
 }
 
+// CrossSign issues a copy of the cert CA signed by the issuer CA, valid until notAfter
+// at the latest. Clients trusting only the issuer can then verify leaves minted by cert.
+func CrossSign(cert, issuer *x509.Certificate, issuerPriv interface{}, notAfter time.Time) (*x509.Certificate, error) {
+	if issuer.MaxPathLen == 0 || issuer.MaxPathLenZero {
+		return nil, fmt.Errorf("ca `%s` does not allow intermediates", issuer.Subject.CommonName)
+	}
+	if notAfter.After(issuer.NotAfter) {
+		notAfter = issuer.NotAfter
+	}
+	if notAfter.After(cert.NotAfter) {
+		notAfter = cert.NotAfter
+	}
+
+	serial, err := rand.Int(rand.Reader, maxSerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:                serial,
+		Subject:                     cert.Subject,
+		SubjectKeyId:                cert.SubjectKeyId,
+		KeyUsage:                    cert.KeyUsage,
+		ExtKeyUsage:                 cert.ExtKeyUsage,
+		BasicConstraintsValid:       true,
+		NotBefore:                   cert.NotBefore,
+		NotAfter:                    notAfter,
+		DNSNames:                    cert.DNSNames,
+		IsCA:                        true,
+		MaxPathLen:                  cert.MaxPathLen,
+		MaxPathLenZero:              cert.MaxPathLenZero,
+		PermittedDNSDomainsCritical: cert.PermittedDNSDomainsCritical,
+		PermittedDNSDomains:         cert.PermittedDNSDomains,
+		ExcludedDNSDomains:          cert.ExcludedDNSDomains,
+		ExcludedIPRanges:            cert.ExcludedIPRanges,
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, cert.PublicKey, issuerPriv)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(raw)
+}
+
+// CertificateSigner is implemented by CA keys which need the whole
+// certificate to sign it, e.g. to enforce a naming policy. Config.PrivateKey
+// may implement it to keep the CA key out of the proxy process.
+type CertificateSigner interface {
+	CreateCertificate(template, parent *x509.Certificate, pub interface{}) ([]byte, error)
+}
+
+func createCertificate(template, parent *x509.Certificate, pub interface{}, priv crypto.Signer) ([]byte, error) {
+	if s, ok := priv.(CertificateSigner); ok {
+		return s.CreateCertificate(template, parent, pub)
+	}
+	return x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
+}
+
 // newMITMConfig creates a MITM config using the CA certificate and
 // private key to generate on-the-fly certificates.
-func newMITMConfig(ca *x509.Certificate, privateKey interface{}, validity time.Duration, organization string) (*mitmConfig, error) {
+func newMITMConfig(ca *x509.Certificate, privateKey crypto.Signer, validity time.Duration, organization string) (*mitmConfig, error) {
 	roots := x509.NewCertPool()
 	roots.AddCert(ca)
 
@@ -138,36 +311,110 @@ func newMITMConfig(ca *x509.Certificate, privateKey interface{}, validity time.D
 		keyID:    keyID,
 		validity: validity,
 		org:      organization,
-		certs:    make(map[string]*tls.Certificate),
+		certs:    make(map[string]*cachedCert),
 		roots:    roots,
+		chain:    [][]byte{ca.Raw},
 	}, nil
 }
 
 // configForTLSADomain returns a *tls.mitmConfig that will generate certificates on-the-fly
-// using the provided hostname
-func (c *mitmConfig) configForTLSADomain(tlsaDomain string) *tls.Config {
+// using the provided hostname, v describes the upstream verification for the issuance log.
+func (c *mitmConfig) configForTLSADomain(tlsaDomain string, v *verification) *tls.Config {
 	return &tls.Config{
 		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			if tlsaDomain != clientHello.ServerName {
 				return nil, fmt.Errorf("tlsa domain `%s` does not match server name `%s`", tlsaDomain, clientHello.ServerName)
 			}
-			return c.cert(tlsaDomain)
+			return c.issue(tlsaDomain, v)
 		},
 	}
 }
 
+// mirrorUpstream copies the names below hostname and the expiry of the verified
+// upstream certificate to tmpl, and describes the verification in the subject.
+func (c *mitmConfig) mirrorUpstream(tmpl *x509.Certificate, hostname string, v *verification) {
+	for _, name := range v.cert.DNSNames {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name == hostname || !strings.HasSuffix(name, "."+hostname) || !permits(c.ca, name) {
+			continue
+		}
+		tmpl.DNSNames = append(tmpl.DNSNames, name)
+	}
+
+	// DANE-EE ignores the upstream validity (RFC 7671),
+	// an expired upstream certificate is not mirrored
+	if v.cert.NotAfter.After(time.Now()) && v.cert.NotAfter.Before(tmpl.NotAfter) {
+		tmpl.NotAfter = v.cert.NotAfter
+	}
+
+	method := "DANE"
+	if v.tofu {
+		method = "TOFU"
+	}
+	ou := []string{fmt.Sprintf("SANE %s verified %s", method, time.Now().UTC().Format(time.RFC3339))}
+	if v.proof != nil {
+		ou = append(ou, fmt.Sprintf("SANE tree root height %d", v.proof.Root.Height))
+	}
+	tmpl.Subject.OrganizationalUnit = ou
+}
+
+// permits checks if the name constraints of ca allow issuing a certificate for name.
+func permits(ca *x509.Certificate, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if net.ParseIP(name) != nil {
+		return len(ca.ExcludedIPRanges) == 0 && len(ca.PermittedIPRanges) == 0
+	}
+
+	for _, d := range ca.ExcludedDNSDomains {
+		if matchDomain(name, d) {
+			return false
+		}
+	}
+	if len(ca.PermittedDNSDomains) == 0 {
+		return true
+	}
+	for _, d := range ca.PermittedDNSDomains {
+		if matchDomain(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain matches name against a dns name constraint as in RFC 5280,
+// a constraint with a leading period only matches names below it.
+func matchDomain(name, constraint string) bool {
+	constraint = strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
 func (c *mitmConfig) cert(hostname string) (*tls.Certificate, error) {
+	return c.issue(hostname, nil)
+}
+
+func (c *mitmConfig) issue(hostname string, v *verification) (*tls.Certificate, error) {
 	// Remove the port if it exists.
 	host, _, err := net.SplitHostPort(hostname)
 	if err == nil {
 		hostname = host
 	}
 
+	// a certificate mirroring an upstream certificate is
+	// replaced when the upstream certificate changes
+	var upstream [sha256.Size]byte
+	if v != nil && v.cert != nil {
+		upstream = sha256.Sum256(v.cert.Raw)
+	}
+
 	c.certmu.RLock()
-	tlsc, ok := c.certs[hostname]
+	cached, ok := c.certs[hostname]
 	c.certmu.RUnlock()
 
-	if ok {
+	if ok && cached.upstream == upstream {
+		tlsc := cached.Certificate
 		// Check validity of the certificate for hostname match, expiry, etc. In
 		// particular, if the cached certificate has expired, create a new one.
 		if _, err := tlsc.Leaf.Verify(x509.VerifyOptions{
@@ -202,8 +449,11 @@ func (c *mitmConfig) cert(hostname string) (*tls.Certificate, error) {
 	} else {
 		tmpl.DNSNames = []string{hostname}
 	}
+	if v != nil && v.cert != nil {
+		c.mirrorUpstream(tmpl, hostname, v)
+	}
 
-	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, c.priv.Public(), c.capriv)
+	raw, err := createCertificate(tmpl, c.ca, c.priv.Public(), c.capriv)
 	if err != nil {
 		return nil, err
 	}
@@ -214,14 +464,20 @@ func (c *mitmConfig) cert(hostname string) (*tls.Certificate, error) {
 		return nil, err
 	}
 
-	tlsc = &tls.Certificate{
-		Certificate: [][]byte{raw, c.ca.Raw},
+	if c.issuances != nil {
+		if err := c.issuances.Append(newIssuance(x509c, v)); err != nil {
+			return nil, fmt.Errorf("issuance log: %v", err)
+		}
+	}
+
+	tlsc := &tls.Certificate{
+		Certificate: append([][]byte{raw}, c.chain...),
 		PrivateKey:  c.priv,
 		Leaf:        x509c,
 	}
 
 	c.certmu.Lock()
-	c.certs[hostname] = tlsc
+	c.certs[hostname] = &cachedCert{tlsc, upstream}
 	c.certmu.Unlock()
 
 	return tlsc, nil
@@ -10,6 +10,9 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/randomlogin/sane/prove"
+	"github.com/randomlogin/sane/sync"
 )
 
 var constraintTest = map[string]struct{}{
@@ -56,7 +59,7 @@ func TestMITM(t *testing.T) {
 		t.Fatalf("NewConfig(): got %v, want no error", err)
 	}
 
-	conf := c.configForTLSADomain("example.com")
+	conf := c.configForTLSADomain("example.com", nil)
 
 	if conf.InsecureSkipVerify {
 		t.Error("conf.InsecureSkipVerify: got true, want false")
@@ -198,3 +201,197 @@ func TestCert(t *testing.T) {
 		t.Fatalf("x509c.IPAddresses: got %v, want %v", got, want)
 	}
 }
+
+func TestCrossSign(t *testing.T) {
+	old, oldPriv, err := NewAuthorityWithPathLen("OLD", "OLD", 24*time.Hour, nil, 1)
+	if err != nil {
+		t.Fatalf("NewAuthorityWithPathLen(): got %v, want no error", err)
+	}
+	next, nextPriv, err := NewAuthorityWithPathLen("NEXT", "NEXT", 24*time.Hour, nil, 1)
+	if err != nil {
+		t.Fatalf("NewAuthorityWithPathLen(): got %v, want no error", err)
+	}
+
+	cross, err := CrossSign(next, old, oldPriv, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CrossSign(): got %v, want no error", err)
+	}
+	if cross.Issuer.CommonName != "OLD" || cross.Subject.CommonName != "NEXT" {
+		t.Errorf("cross: got issuer %q subject %q, want OLD and NEXT", cross.Issuer.CommonName, cross.Subject.CommonName)
+	}
+
+	c, err := newMITMConfig(next, nextPriv, time.Hour, "NEXT")
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	c.chain = [][]byte{cross.Raw}
+
+	tlsc, err := c.cert("example.com")
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+
+	// leaves minted by the next CA verify with either root trusted
+	for _, root := range []*x509.Certificate{old, next} {
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+		intermediates := x509.NewCertPool()
+		intermediates.AddCert(cross)
+
+		if _, err := tlsc.Leaf.Verify(x509.VerifyOptions{
+			DNSName:       "example.com",
+			Roots:         roots,
+			Intermediates: intermediates,
+		}); err != nil {
+			t.Errorf("Verify() with root %s: got %v, want no error", root.Subject.CommonName, err)
+		}
+	}
+
+	legacy, legacyPriv, _ := NewAuthority("LEGACY", "LEGACY", 24*time.Hour, nil)
+	if _, err := CrossSign(next, legacy, legacyPriv, time.Now().Add(time.Hour)); err == nil {
+		t.Error("CrossSign() with path length 0 issuer: got nil, want error")
+	}
+}
+
+func TestNewIntermediate(t *testing.T) {
+	root, rootPriv, err := NewAuthorityWithPathLen("ROOT", "ROOT", 24*time.Hour, nil, 1)
+	if err != nil {
+		t.Fatalf("NewAuthorityWithPathLen(): got %v, want no error", err)
+	}
+
+	inter, interPriv, err := NewIntermediate("INTERMEDIATE", "ROOT", 48*time.Hour, root, rootPriv)
+	if err != nil {
+		t.Fatalf("NewIntermediate(): got %v, want no error", err)
+	}
+	if !inter.NotAfter.Equal(root.NotAfter) {
+		t.Errorf("NotAfter: got %v, want %v", inter.NotAfter, root.NotAfter)
+	}
+
+	c, err := newMITMConfig(inter, interPriv, time.Hour, "ROOT")
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+
+	tlsc, err := c.cert("example.com")
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", "example.com", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(inter)
+	if _, err := tlsc.Leaf.Verify(x509.VerifyOptions{
+		DNSName:       "example.com",
+		Roots:         roots,
+		Intermediates: intermediates,
+	}); err != nil {
+		t.Errorf("Verify(): got %v, want no error", err)
+	}
+
+	legacy, legacyPriv, _ := NewAuthority("LEGACY", "LEGACY", 24*time.Hour, nil)
+	if _, _, err := NewIntermediate("INTERMEDIATE", "LEGACY", time.Hour, legacy, legacyPriv); err == nil {
+		t.Error("NewIntermediate() with path length 0 root: got nil, want error")
+	}
+}
+
+func TestPermittedAuthority(t *testing.T) {
+	ca, priv, err := NewPermittedAuthority("TEST", "TEST", 24*time.Hour, []string{"htools", ".Lazydane"}, 0)
+	if err != nil {
+		t.Fatalf("NewPermittedAuthority(): got %v, want no error", err)
+	}
+	excluded, _, err := NewAuthority("TEST", "TEST", 24*time.Hour, map[string]struct{}{"com": {}})
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	tests := []struct {
+		ca   *x509.Certificate
+		name string
+		want bool
+	}{
+		{ca, "htools", true},
+		{ca, "www.htools", true},
+		{ca, "test.lazydane", true},
+		{ca, "example.com", false},
+		{ca, "nothtools", false},
+		{ca, "127.0.0.1", false},
+		{excluded, "example.com", false},
+		{excluded, "htools", true},
+	}
+	for _, test := range tests {
+		if got := permits(test.ca, test.name); got != test.want {
+			t.Errorf("permits(%v, %q): got %v, want %v", test.ca.PermittedDNSDomains, test.name, got, test.want)
+		}
+	}
+
+	c, err := newMITMConfig(ca, priv, time.Hour, "TEST")
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, test := range tests[:4] {
+		tlsc, err := c.cert(test.name)
+		if err != nil {
+			t.Fatalf("c.cert(%q): got %v, want no error", test.name, err)
+		}
+		_, err = tlsc.Leaf.Verify(x509.VerifyOptions{DNSName: test.name, Roots: roots})
+		if (err == nil) != test.want {
+			t.Errorf("Verify(%q): got %v, want valid %v", test.name, err, test.want)
+		}
+	}
+
+	if _, _, err := NewPermittedAuthority("TEST", "TEST", time.Hour, nil, 0); err == nil {
+		t.Error("NewPermittedAuthority() without tlds: got nil, want error")
+	}
+}
+
+func TestMirrorUpstream(t *testing.T) {
+	ca, priv, err := NewPermittedAuthority("TEST", "TEST", 24*time.Hour, []string{"htools"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newMITMConfig(ca, priv, time.Hour, "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := &x509.Certificate{
+		DNSNames: []string{"shop.htools", "www.shop.htools", "*.shop.htools", "htools", "example.com"},
+		NotAfter: time.Now().Add(30 * time.Minute).Truncate(time.Second),
+	}
+	v := &verification{cert: upstream, proof: &prove.Proof{Root: sync.BlockInfo{Height: 1234}}}
+
+	tlsc, err := c.issue("shop.htools", v)
+	if err != nil {
+		t.Fatalf("c.issue(): got %v, want no error", err)
+	}
+	leaf := tlsc.Leaf
+
+	want := []string{"shop.htools", "www.shop.htools", "*.shop.htools"}
+	if !reflect.DeepEqual(leaf.DNSNames, want) {
+		t.Errorf("DNSNames: got %v, want %v", leaf.DNSNames, want)
+	}
+	if !leaf.NotAfter.Equal(upstream.NotAfter) {
+		t.Errorf("NotAfter: got %v, want %v", leaf.NotAfter, upstream.NotAfter)
+	}
+	if ou := strings.Join(leaf.Subject.OrganizationalUnit, ", "); !strings.Contains(ou, "DANE verified") || !strings.Contains(ou, "height 1234") {
+		t.Errorf("OrganizationalUnit: got %q", ou)
+	}
+
+	// expired upstream certificates are not mirrored
+	upstream.NotAfter = time.Now().Add(-time.Hour)
+	upstream.Raw = []byte{1}
+	tlsc, err = c.issue("shop.htools", v)
+	if err != nil {
+		t.Fatalf("c.issue(): got %v, want no error", err)
+	}
+	if !tlsc.Leaf.NotAfter.After(time.Now()) {
+		t.Errorf("NotAfter: got %v, want unclamped", tlsc.Leaf.NotAfter)
+	}
+	// a rotated upstream certificate replaces the cached one
+	if len(c.certs) != 1 {
+		t.Errorf("cached certs: got %d, want 1", len(c.certs))
+	}
+}
@@ -0,0 +1,105 @@
+package sane
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ClientIdentity references a client certificate presented to upstream
+// servers of Domain. Either Cert and Key PEM files or a PKCS#12 bundle
+// must be set. Domain may start with "*." to match a single label.
+type ClientIdentity struct {
+	Domain   string `json:"domain"`
+	Cert     string `json:"cert,omitempty"`
+	Key      string `json:"key,omitempty"`
+	PKCS12   string `json:"pkcs12,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// ClientIdentities is a per-domain store of client certificates
+// used when an upstream server requests one.
+type ClientIdentities struct {
+	certs map[string]*tls.Certificate
+}
+
+// LoadClientIdentities reads a json list of client identities
+// from the given file and loads the referenced certificates.
+func LoadClientIdentities(path string) (*ClientIdentities, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []ClientIdentity
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return nil, fmt.Errorf("couldn't parse client identities: %v", err)
+	}
+
+	c := &ClientIdentities{certs: make(map[string]*tls.Certificate)}
+	for _, id := range ids {
+		cert, err := id.load()
+		if err != nil {
+			return nil, fmt.Errorf("client identity for %s: %v", id.Domain, err)
+		}
+		c.certs[strings.ToLower(strings.TrimSuffix(id.Domain, "."))] = cert
+	}
+
+	return c, nil
+}
+
+func (id *ClientIdentity) load() (*tls.Certificate, error) {
+	if id.PKCS12 == "" {
+		cert, err := tls.LoadX509KeyPair(id.Cert, id.Key)
+		return &cert, err
+	}
+
+	pfx, err := os.ReadFile(id.PKCS12)
+	if err != nil {
+		return nil, err
+	}
+
+	key, leaf, chain, err := pkcs12.DecodeChain(pfx, id.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{PrivateKey: key, Leaf: leaf}
+	cert.Certificate = append(cert.Certificate, leaf.Raw)
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+// lookup returns the client certificate configured for host if any.
+func (c *ClientIdentities) lookup(host string) *tls.Certificate {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if cert, ok := c.certs[host]; ok {
+		return cert
+	}
+
+	if i := strings.IndexByte(host, '.'); i != -1 {
+		if cert, ok := c.certs["*"+host[i:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// getClientCertificate returns a function that presents the client certificate
+// for host when the upstream server requests one.
+func (c *ClientIdentities) getClientCertificate(host string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert := c.lookup(host)
+		if cert == nil || cri.SupportsCertificate(cert) != nil {
+			// sending no certificate lets the server decide
+			return &tls.Certificate{}, nil
+		}
+		return cert, nil
+	}
+}
@@ -0,0 +1,137 @@
+package sane
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeClientIdentity(t *testing.T, dir, name string) (certFile, keyFile string) {
+	cert, priv, err := NewAuthority(name, name, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0600)
+	return
+}
+
+func TestClientIdentities(t *testing.T) {
+	dir := t.TempDir()
+	dashCert, dashKey := writeClientIdentity(t, dir, "dash")
+	corpCert, corpKey := writeClientIdentity(t, dir, "corp")
+
+	config := filepath.Join(dir, "clients.json")
+	os.WriteFile(config, []byte(fmt.Sprintf(`[
+		{"domain": "dash.example", "cert": %q, "key": %q},
+		{"domain": "*.corp.", "cert": %q, "key": %q}
+	]`, dashCert, dashKey, corpCert, corpKey)), 0600)
+
+	ids, err := LoadClientIdentities(config)
+	if err != nil {
+		t.Fatalf("LoadClientIdentities(): got %v, want no error", err)
+	}
+
+	var tests = []struct {
+		host string
+		want string
+	}{
+		{"dash.example", "dash"},
+		{"DASH.example.", "dash"},
+		{"www.dash.example", ""},
+		{"wiki.corp", "corp"},
+		{"corp", ""},
+		{"a.wiki.corp", ""},
+	}
+
+	for _, test := range tests {
+		cert := ids.lookup(test.host)
+		got := ""
+		if cert != nil {
+			leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+			got = leaf.Subject.CommonName
+		}
+		if got != test.want {
+			t.Errorf("lookup(%q): got %q, want %q", test.host, got, test.want)
+		}
+	}
+
+	if _, err := LoadClientIdentities(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("LoadClientIdentities(missing file): got nil, want error")
+	}
+}
+
+func TestClientIdentitiesHandshake(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeClientIdentity(t, dir, "dash")
+	config := filepath.Join(dir, "clients.json")
+	os.WriteFile(config, []byte(fmt.Sprintf(`[{"domain": "dash.example", "cert": %q, "key": %q}]`, certFile, keyFile)), 0600)
+
+	ids, err := LoadClientIdentities(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, priv, _ := NewAuthority("server", "server", time.Hour, nil)
+	mitm, _ := newMITMConfig(ca, priv, time.Hour, "server")
+	serverCert, _ := mitm.cert("dash.example")
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan *x509.Certificate, 1)
+	go func() {
+		defer serverConn.Close()
+		server := tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{*serverCert},
+			ClientAuth:   tls.RequireAnyClientCert,
+		})
+		if err := server.Handshake(); err != nil {
+			done <- nil
+			return
+		}
+		done <- server.ConnectionState().PeerCertificates[0]
+	}()
+
+	clientConfig := newTLSConfig("dash.example", nil, false, nil, nil, nil)
+	clientConfig.VerifyConnection = nil
+	clientConfig.GetClientCertificate = ids.getClientCertificate("dash.example")
+	if err := tls.Client(clientConn, clientConfig).Handshake(); err != nil {
+		t.Fatalf("client handshake: got %v, want no error", err)
+	}
+
+	peer := <-done
+	if peer == nil || peer.Subject.CommonName != "dash" {
+		t.Fatalf("server got client certificate %v, want dash", peer)
+	}
+}
+
+func TestClientIdentitiesPKCS12(t *testing.T) {
+	// exported by OpenSSL 3 with PBES2 and AES-256-CBC
+	dir := t.TempDir()
+	config := filepath.Join(dir, "clients.json")
+	os.WriteFile(config, []byte(`[{"domain": "aes.example", "pkcs12": "testdata/client_aes.p12", "password": "sane"}]`), 0600)
+
+	ids, err := LoadClientIdentities(config)
+	if err != nil {
+		t.Fatalf("LoadClientIdentities(): got %v, want no error", err)
+	}
+	cert := ids.lookup("aes.example")
+	if cert == nil || cert.Leaf.Subject.CommonName != "aes" {
+		t.Fatalf("lookup(aes.example): got %v, want the aes certificate", cert)
+	}
+
+	os.WriteFile(config, []byte(`[{"domain": "aes.example", "pkcs12": "testdata/client_aes.p12", "password": "wrong"}]`), 0600)
+	if _, err := LoadClientIdentities(config); err == nil {
+		t.Error("LoadClientIdentities(wrong password): got nil, want error")
+	}
+}
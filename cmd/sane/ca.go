@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	sane "github.com/randomlogin/sane"
+	"github.com/randomlogin/sane/tld"
+)
+
+const (
+	caName          = "Stateless DANE"
+	caValidity      = 365 * 24 * time.Hour
+	caExpiryWarning = 30 * 24 * time.Hour
+
+	// file name prefixes of the CA files in the conf dir
+	caCurrent = "cert"
+	caNext    = "cert.next"
+	caPrev    = "cert.prev"
+	// cross-signed copy of the current CA issued by the previous one
+	caCross     = "cert.cross"
+	caNextCross = "cert.next.cross"
+	// intermediate CA held by the proxy, issued by the current CA
+	caIntermediate     = "intermediate"
+	caPrevIntermediate = "intermediate.prev"
+
+	intermediateValidity = 90 * 24 * time.Hour
+)
+
+// caFiles returns the certificate and key paths in the conf dir for the given prefix.
+func caFiles(prefix string) (string, string) {
+	p := getConfPath()
+	return path.Join(p, prefix+".crt"), path.Join(p, prefix+".key")
+}
+
+// permittedTLDs returns the tlds given with -permit-tlds.
+func permittedTLDs() []string {
+	var tlds []string
+	for _, t := range strings.Split(*permitTLDs, ",") {
+		if t = strings.ToLower(strings.Trim(strings.TrimSpace(t), ".")); t != "" {
+			tlds = append(tlds, t)
+		}
+	}
+	sort.Strings(tlds)
+	return tlds
+}
+
+// newCA generates a CA limited to -permit-tlds if given, otherwise
+// excluding constraints.
+func newCA(name string, validity time.Duration, constraints map[string]struct{}) (*x509.Certificate, *rsa.PrivateKey, error) {
+	if tlds := permittedTLDs(); len(tlds) > 0 {
+		if *skipICANN {
+			return nil, nil, errors.New("-permit-tlds and -skip-icann are mutually exclusive")
+		}
+		return sane.NewPermittedAuthority(name, caName, validity, tlds, 1)
+	}
+	return sane.NewAuthorityWithPathLen(name, caName, validity, constraints, 1)
+}
+
+// warnCAConstraints warns if ca is not limited to the tlds given with -permit-tlds.
+func warnCAConstraints(ca *x509.Certificate) {
+	tlds := permittedTLDs()
+	if len(tlds) == 0 {
+		return
+	}
+
+	permitted := append([]string(nil), ca.PermittedDNSDomains...)
+	sort.Strings(permitted)
+	if strings.Join(permitted, ",") != strings.Join(tlds, ",") {
+		log.Printf("[WARN] CA `%s` permits %v but -permit-tlds is %v, run `sane ca rotate` and `sane ca switch` to re-issue it",
+			ca.Subject.CommonName, permitted, tlds)
+	}
+}
+
+// caConstraints returns the name constraints for newly generated CAs.
+func caConstraints() map[string]struct{} {
+	if *skipICANN {
+		return tld.ICANN()
+	}
+	return nil
+}
+
+func writeCert(certPath string, cert *x509.Certificate) error {
+	b := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	})
+	if err := os.WriteFile(certPath, b, 0644); err != nil {
+		return fmt.Errorf("couldn't create CA file: %v", err)
+	}
+	return nil
+}
+
+func writeCA(certPath, keyPath string, ca *x509.Certificate, priv *rsa.PrivateKey) error {
+	if err := writeCert(certPath, ca); err != nil {
+		return err
+	}
+
+	block := &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	}
+	if *encryptKey {
+		var err error
+		if block, err = encryptKeyBlock(priv); err != nil {
+			return err
+		}
+	}
+
+	return writeKey(keyPath, block)
+}
+
+func writeKey(keyPath string, block *pem.Block) error {
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("couldn't create CA private key file: %v", err)
+	}
+	return nil
+}
+
+// caPassphrase returns the CA passphrase from -pass or DANE_CA_PASS.
+func caPassphrase() ([]byte, error) {
+	if *pass == "" {
+		*pass = os.Getenv("DANE_CA_PASS")
+	}
+	if *pass == "" {
+		return nil, errors.New("CA passphrase is not set, use -pass or DANE_CA_PASS")
+	}
+	return []byte(*pass), nil
+}
+
+func encryptKeyBlock(priv interface{}) (*pem.Block, error) {
+	p, err := caPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	var kdf sane.KDF
+	switch *keyKDF {
+	case "scrypt":
+		kdf = sane.KDFScrypt
+	case "pbkdf2":
+		kdf = sane.KDFPBKDF2
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function %s", *keyKDF)
+	}
+
+	return sane.EncryptPKCS8PrivateKey(priv, p, kdf)
+}
+
+// readKey reads a CA private key file decrypting it if needed,
+// the returned key is pem encoded.
+func readKey(keyPath string) ([]byte, error) {
+	b, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in %s", keyPath)
+	}
+
+	switch {
+	case block.Type == sane.EncryptedKeyBlockType:
+		p, err := caPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		priv, err := sane.DecryptPKCS8PrivateKey(block.Bytes, p)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	case x509.IsEncryptedPEMBlock(block):
+		// legacy RFC 1423 encryption
+		p, err := caPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.DecryptPEMBlock(block, p)
+		if err != nil {
+			return nil, fmt.Errorf("decryption failed: %v", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+	}
+
+	return b, nil
+}
+
+func readCert(certPath string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", certPath)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// loadCAChain returns the certificates sent after minted leaves. During the overlap
+// period following a rotation this is the current CA cross-signed by the previous one.
+func loadCAChain(ca *x509.Certificate) []*x509.Certificate {
+	crossPath, _ := caFiles(caCross)
+	cross, err := readCert(crossPath)
+	if err != nil {
+		return nil
+	}
+
+	if time.Now().After(cross.NotAfter) || !bytes.Equal(cross.RawSubjectPublicKeyInfo, ca.RawSubjectPublicKeyInfo) {
+		return nil
+	}
+	return []*x509.Certificate{cross}
+}
+
+// warnCAExpiry logs a warning when the CA is about to expire.
+func warnCAExpiry(ca *x509.Certificate) {
+	left := time.Until(ca.NotAfter)
+	if left <= 0 {
+		log.Printf("[WARN] CA expired on %s, run `sane ca rotate` and `sane ca switch`", ca.NotAfter.Format(time.RFC3339))
+		return
+	}
+	if left < caExpiryWarning {
+		log.Printf("[WARN] CA expires in %d days on %s, run `sane ca rotate`", int(left.Hours()/24), ca.NotAfter.Format(time.RFC3339))
+	}
+}
+
+func caCommand(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "status":
+		return caStatus()
+	case "rotate":
+		return caRotate(args[1:])
+	case "switch":
+		return caSwitch()
+	case "issue-intermediate":
+		return caIssueIntermediate(args[1:])
+	case "encrypt":
+		return caEncrypt(true)
+	case "decrypt":
+		return caEncrypt(false)
+	}
+	return errUsage
+}
+
+func caStatus() error {
+	for _, prefix := range []string{caCurrent, caIntermediate, caCross, caNext, caNextCross} {
+		p, _ := caFiles(prefix)
+		if prefix == caCurrent && *certPath != "" {
+			p = *certPath
+		}
+
+		cert, err := readCert(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s\n  subject: %s\n  issuer: %s\n  not after: %s\n",
+			p, cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.Format(time.RFC3339))
+		if len(cert.PermittedDNSDomains) > 0 {
+			fmt.Printf("  permitted: %s\n", strings.Join(cert.PermittedDNSDomains, ", "))
+		} else if len(cert.ExcludedDNSDomains) > 0 {
+			fmt.Printf("  excluded: %d tlds\n", len(cert.ExcludedDNSDomains))
+		}
+	}
+	return nil
+}
+
+// caRotate issues the next CA without switching to it.
+func caRotate(args []string) error {
+	fs := flag.NewFlagSet("ca rotate", flag.ContinueOnError)
+	validity := fs.Duration("validity", caValidity, "validity of the new CA")
+	crossSign := fs.Bool("cross-sign", false, "cross-sign the new CA with the current one")
+	overlap := fs.Duration("overlap", 30*24*time.Hour, "validity of the cross-signed CA")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	nextCert, nextKey := caFiles(caNext)
+	if _, err := os.Stat(nextCert); err == nil {
+		return fmt.Errorf("%s already exists, run `sane ca switch` or remove it", nextCert)
+	}
+
+	// CAs made before path lengths were set can't issue intermediates,
+	// fail before generating the new CA
+	var oldCert *x509.Certificate
+	var oldKey crypto.PrivateKey
+	if *crossSign {
+		certPath, keyPath := getOrCreateCA(caConstraints())
+		old, err := loadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return err
+		}
+		oldKey = old.PrivateKey
+		if oldCert, err = x509.ParseCertificate(old.Certificate[0]); err != nil {
+			return err
+		}
+		if oldCert.MaxPathLen == 0 || oldCert.MaxPathLenZero {
+			return fmt.Errorf("-cross-sign needs a CA made with a path length, the current CA `%s` was made without one, "+
+				"rotate without -cross-sign and add the new CA to your browsers", oldCert.Subject.CommonName)
+		}
+	}
+
+	name := fmt.Sprintf("%s (%s)", caName, time.Now().Format("2006-01-02"))
+	ca, priv, err := newCA(name, *validity, caConstraints())
+	if err != nil {
+		return fmt.Errorf("couldn't generate CA: %v", err)
+	}
+
+	if *crossSign {
+		cross, err := sane.CrossSign(ca, oldCert, oldKey, time.Now().Add(*overlap))
+		if err != nil {
+			return fmt.Errorf("couldn't cross-sign CA: %v", err)
+		}
+		crossPath, _ := caFiles(caNextCross)
+		if err := writeCert(crossPath, cross); err != nil {
+			return err
+		}
+	}
+
+	if err := writeCA(nextCert, nextKey, ca, priv); err != nil {
+		return err
+	}
+
+	log.Printf("new CA written to %s, add it to your browsers and run `sane ca switch`", nextCert)
+	return nil
+}
+
+// caIssueIntermediate issues a new intermediate CA signed by the current CA. The current
+// CA private key is only needed here and can be kept offline otherwise.
+func caIssueIntermediate(args []string) error {
+	fs := flag.NewFlagSet("ca issue-intermediate", flag.ContinueOnError)
+	validity := fs.Duration("validity", intermediateValidity, "validity of the intermediate CA")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rootCert, rootKey := caFiles(caCurrent)
+	if *certPath != "" && *keyPath != "" {
+		rootCert, rootKey = *certPath, *keyPath
+	}
+
+	root, err := loadX509KeyPair(rootCert, rootKey)
+	if err != nil {
+		return err
+	}
+	rootCA, err := x509.ParseCertificate(root.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s Intermediate (%s)", caName, time.Now().Format("2006-01-02"))
+	inter, priv, err := sane.NewIntermediate(name, caName, *validity, rootCA, root.PrivateKey.(crypto.Signer))
+	if err != nil {
+		return fmt.Errorf("couldn't issue intermediate CA: %v", err)
+	}
+
+	interCert, interKey := caFiles(caIntermediate)
+	prevCert, prevKey := caFiles(caPrevIntermediate)
+	if _, err := os.Stat(interCert); err == nil {
+		if err := os.Rename(interCert, prevCert); err != nil {
+			return err
+		}
+		if err := os.Rename(interKey, prevKey); err != nil {
+			return err
+		}
+	}
+
+	if err := writeCA(interCert, interKey, inter, priv); err != nil {
+		return err
+	}
+
+	log.Printf("intermediate CA written to %s, restart sane to use it", interCert)
+	return nil
+}
+
+// caSwitch replaces the current CA with the next one, keeping the current as previous.
+func caSwitch() error {
+	if *certPath != "" || *keyPath != "" {
+		return errors.New("custom CA files are not managed by sane")
+	}
+
+	nextCert, nextKey := caFiles(caNext)
+	if _, err := os.Stat(nextCert); err != nil {
+		return fmt.Errorf("no next CA found, run `sane ca rotate` first")
+	}
+	// both files are checked before anything is moved
+	for _, p := range []string{nextCert, nextKey} {
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("can't switch to the next CA: %v", err)
+		}
+		f.Close()
+	}
+
+	curCert, curKey := caFiles(caCurrent)
+	prevCert, prevKey := caFiles(caPrev)
+	crossPath, _ := caFiles(caCross)
+	nextCross, _ := caFiles(caNextCross)
+
+	// keys are moved before certs so a cert is never current without
+	// its key, the moves done are rolled back if one fails
+	renames := [][2]string{
+		{curKey, prevKey},
+		{curCert, prevCert},
+		{nextKey, curKey},
+		{nextCert, curCert},
+	}
+	for i, r := range renames {
+		if err := os.Rename(r[0], r[1]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				os.Rename(renames[j][1], renames[j][0])
+			}
+			return err
+		}
+	}
+
+	if _, err := os.Stat(nextCross); err == nil {
+		if err := os.Rename(nextCross, crossPath); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(crossPath)
+	}
+
+	log.Printf("switched to the CA in %s, restart sane to use it", curCert)
+	return nil
+}
+
+// caEncrypt converts the CA private key in place to an encrypted
+// or an unencrypted key.
+func caEncrypt(encrypt bool) error {
+	_, p := caFiles(caCurrent)
+	if *keyPath != "" {
+		p = *keyPath
+	}
+
+	b, err := readKey(p)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(b)
+	if !encrypt {
+		return writeKey(p, block)
+	}
+
+	priv, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if block, err = encryptKeyBlock(priv); err != nil {
+		return err
+	}
+	return writeKey(p, block)
+}
+
+func parsePrivateKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key type")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	sane "github.com/randomlogin/sane"
+)
+
+const pinsFileName = "pins.json"
+
+var errUsage = errors.New(`usage: sane [flags] <command>
+
+commands:
+  ca status                 show the current, cross-signed and next CA
+  ca rotate [-validity d] [-cross-sign] [-overlap d]
+                            issue the next CA, optionally cross-signed by the current one
+  ca switch                 start using the next CA, the current one is kept as cert.prev
+  ca issue-intermediate [-validity d]
+                            issue an intermediate CA signing certificates instead of the CA,
+                            the CA private key can be kept offline afterwards
+  ca encrypt                encrypt the CA private key with -pass or DANE_CA_PASS
+  ca decrypt                store the CA private key unencrypted
+  signer -socket <path> [-permit domains] [-allow-digest]
+                            hold the CA private key and sign certificates for a proxy
+                            started with -signer <path>
+  tld update -from <file>   import the ICANN tld list from a file in the IANA format,
+                            the embedded list is used until then
+  log verify [file]         check the hash chain of the issuance log
+  pin list                  list pinned keys for handshake names
+  pin approve <host>        replace the pin for host with its pending key
+  pin revoke <host>         remove the pin for host`)
+
+// runCommand runs a management command given after the flags.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "ca":
+		return caCommand(args[1:])
+	case "signer":
+		return signerCommand(args[1:])
+	case "pin":
+		return pinCommand(args[1:])
+	case "tld":
+		return tldCommand(args[1:])
+	case "log":
+		return logCommand(args[1:])
+	}
+	return errUsage
+}
+
+func pinCommand(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	pins, err := sane.NewPinStore(path.Join(getConfPath(), pinsFileName))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		list, err := pins.List()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tSPKI\tFIRST SEEN\tPENDING")
+		for _, p := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Host, p.SPKI, p.FirstSeen.Format(time.RFC3339), p.Pending)
+		}
+		return w.Flush()
+	case args[0] == "approve" && len(args) == 2:
+		return pins.Approve(args[1])
+	case args[0] == "revoke" && len(args) == 2:
+		return pins.Revoke(args[1])
+	}
+
+	return errUsage
+}
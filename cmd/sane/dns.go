@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/miekg/dns"
+	rs "github.com/randomlogin/sane/resolver"
+)
+
+// serveDNS answers dns queries with r on -dns-addr over udp and tcp, on
+// -dot-addr over tls and on -doh-addr over https, listeners failing later
+// are fatal.
+func serveDNS(r rs.Resolver) error {
+	h := &rs.Server{Resolver: r}
+
+	var tlsConfig *tls.Config
+	if *dotAddr != "" || *dohAddr != "" {
+		if *dotCert == "" || *dotKey == "" {
+			return errors.New("-dot-addr and -doh-addr need -dot-cert and -dot-key")
+		}
+		cert, err := tls.LoadX509KeyPair(*dotCert, *dotKey)
+		if err != nil {
+			return fmt.Errorf("failed to load the dns over tls certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	var servers []*dns.Server
+	if *dnsAddr != "" {
+		servers = append(servers,
+			&dns.Server{Addr: *dnsAddr, Net: "udp", Handler: h},
+			&dns.Server{Addr: *dnsAddr, Net: "tcp", Handler: h},
+		)
+	}
+	if *dotAddr != "" {
+		servers = append(servers, &dns.Server{Addr: *dotAddr, Net: "tcp-tls", Handler: h, TLSConfig: tlsConfig})
+	}
+
+	for _, srv := range servers {
+		log.Printf("DNS listening on %s (%s)", srv.Addr, srv.Net)
+		go func(srv *dns.Server) {
+			log.Fatal(srv.ListenAndServe())
+		}(srv)
+	}
+
+	// browsers only accept https urls for DoH
+	if *dohAddr != "" {
+		srv := &http.Server{Addr: *dohAddr, Handler: dohHandler(r), TLSConfig: tlsConfig}
+		log.Printf("DNS listening on https://%s/dns-query", srv.Addr)
+		go func() {
+			log.Fatal(srv.ListenAndServeTLS("", ""))
+		}()
+	}
+	return nil
+}
+
+// dohHandler answers DoH queries at /dns-query with r, it is served
+// on -doh-addr and mounted on the proxy port for relative urls.
+func dohHandler(r rs.Resolver) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", &rs.Server{Resolver: r})
+	return mux
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"path"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/randomlogin/sane/hsd"
+	"github.com/randomlogin/sane/prove"
+	rs "github.com/randomlogin/sane/resolver"
+	"github.com/randomlogin/sane/sync"
+	"github.com/randomlogin/sane/tld"
+)
+
+// how often tree roots are read from hsd
+const hsdRootsInterval = 10 * time.Minute
+
+// useHSD reads tree roots and urkel proofs from the hsd node at -hsd,
+// and returns a resolver for Handshake names delegated by its name resources.
+func useHSD(ctx context.Context, c *hsd.Client, confPath string) rs.Resolver {
+	rootsPath := path.Join(confPath, "roots.json")
+	if err := syncHSDRoots(ctx, c, rootsPath); err != nil {
+		log.Fatalf("failed to read tree roots from hsd: %v", err)
+	}
+	log.Print("Successfully read last tree roots from hsd")
+	go func() {
+		for {
+			time.Sleep(hsdRootsInterval)
+			if err := syncHSDRoots(ctx, c, rootsPath); err != nil {
+				log.Printf("[WARN] failed to read tree roots from hsd: %v", err)
+			}
+		}
+	}()
+
+	prove.SetUrkelSource(func(tld string) ([]byte, error) {
+		p, err := c.NameProof(ctx, tld)
+		if err != nil {
+			return nil, err
+		}
+		return p.Extension()
+	})
+
+	return rs.NewHSD(func(ctx context.Context, tld string) ([]dns.RR, error) {
+		res, err := c.NameResource(ctx, tld)
+		if err != nil || res == nil {
+			return nil, err
+		}
+		return res.RRs(tld), nil
+	})
+}
+
+func syncHSDRoots(ctx context.Context, c *hsd.Client, rootsPath string) error {
+	roots, err := c.TreeRoots(ctx, sync.BlocksToStore)
+	if err != nil {
+		return err
+	}
+	return sync.WriteStoredRoots(rootsPath, roots)
+}
+
+// splitResolver resolves ICANN names and Handshake names with different resolvers.
+type splitResolver struct {
+	icann rs.Resolver
+	hns   rs.Resolver
+}
+
+func (s *splitResolver) pick(host string) rs.Resolver {
+	if tld.IsICANN(host) {
+		return s.icann
+	}
+	return s.hns
+}
+
+func (s *splitResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, bool, error) {
+	return s.pick(host).LookupIP(ctx, network, host)
+}
+
+func (s *splitResolver) LookupTLSA(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
+	return s.pick(name).LookupTLSA(ctx, service, proto, name)
+}
+
+func (s *splitResolver) LookupSVCB(ctx context.Context, name string) ([]*dns.SVCB, bool, error) {
+	return s.pick(name).LookupSVCB(ctx, name)
+}
+
+func (s *splitResolver) LookupHTTPS(ctx context.Context, name string) ([]*dns.HTTPS, bool, error) {
+	return s.pick(name).LookupHTTPS(ctx, name)
+}
+
+func (s *splitResolver) LookupCNAME(ctx context.Context, host string) (string, bool, error) {
+	return s.pick(host).LookupCNAME(ctx, host)
+}
+
+func (s *splitResolver) Lookup(ctx context.Context, name string, qtype uint16) *rs.DNSResult {
+	return s.pick(name).Lookup(ctx, name, qtype)
+}
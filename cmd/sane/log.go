@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	sane "github.com/randomlogin/sane"
+)
+
+const issuanceLogFileName = "issued.jsonl"
+
+func logCommand(args []string) error {
+	if len(args) == 0 || args[0] != "verify" || len(args) > 2 {
+		return errUsage
+	}
+
+	p := path.Join(getConfPath(), issuanceLogFileName)
+	if len(args) == 2 {
+		p = args[1]
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := sane.VerifyIssuanceLog(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	fmt.Printf("%s: %d entries, hash chain intact\n", p, n)
+	return nil
+}
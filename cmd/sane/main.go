@@ -1,11 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
@@ -19,23 +18,30 @@ import (
 	"github.com/buffrr/hsig0"
 	"github.com/miekg/dns"
 	sane "github.com/randomlogin/sane"
+	"github.com/randomlogin/sane/hsd"
 	rs "github.com/randomlogin/sane/resolver"
+	"github.com/randomlogin/sane/signer"
 	"github.com/randomlogin/sane/sync"
-	"github.com/randomlogin/sane/tld"
 )
 
 const KSK2017 = `. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D`
 
 var (
-	raddr              = flag.String("r", "", "dns resolvers to use (default: /etc/resolv.conf)")
+	raddr              = flag.String("r", "", "comma-separated list of dns resolvers to use as udp://, tcp://, tls://, https://, quic:// urls or host:port, optionally prefixed with a SIG(0) key as key@host:port (default: /etc/resolv.conf)")
+	resolverStrategy   = flag.String("r-strategy", "failover", "how resolvers given with -r are queried: failover, random, fastest or race")
 	output             = flag.String("o", "", "path to export the public CA file")
 	conf               = flag.String("conf", "", "dir path to store configuration (default: ~/.sane)")
 	addr               = flag.String("addr", ":8080", "host:port of the proxy")
 	certPath           = flag.String("cert", "", "filepath to custom CA")
 	keyPath            = flag.String("key", "", "filepath to the CA's private key")
 	pass               = flag.String("pass", "", "CA passphrase or use DANE_CA_PASS environment variable to decrypt CA file (if encrypted)")
+	encryptKey         = flag.Bool("encrypt-key", false, "encrypt generated CA private keys with the CA passphrase")
+	keyKDF             = flag.String("key-kdf", "scrypt", "key derivation function for encrypted CA private keys: scrypt or pbkdf2")
 	anchor             = flag.String("anchor", "", "path to trust anchor file (default: hardcoded 2017 KSK)")
-	hsd                = flag.String("hsd", "", "url to the prefered hsd node")
+	recursive          = flag.Bool("recursive", false, "resolve with the unbound recursive resolver validating from -anchor, forwarding to -r if given (needs a build with -tags unbound)")
+	unboundConf        = flag.String("unbound-conf", "", "path to an unbound configuration file loaded by -recursive")
+	hsdURL             = flag.String("hsd", "", "url to the prefered hsd node, used instead of hnsd for tree roots, urkel proofs and resolving handshake names")
+	hsdAPIKey          = flag.String("hsd-api-key", os.Getenv("HSD_API_KEY"), "api key of the hsd node, also may be set as environment variable HSD_API_KEY")
 	verbose            = flag.Bool("verbose", false, "verbose output for debugging")
 	skipICANN          = flag.Bool("skip-icann", false, "skip TLSA lookups for ICANN tlds and include them in the CA name constraints extension")
 	validity           = flag.Duration("validity", time.Hour, "window of time generated DANE certificates are valid")
@@ -45,6 +51,24 @@ var (
 	hnsdCheckpointPath = flag.String("checkpoint", "", "path to hnsd checkpoint location, default ~/.hnsd")
 	resyncInterval     = flag.Duration("resync-interval", 24*time.Hour, "interval for roots resyncronization")
 	externalService    = flag.String("external-service", "", "uri to an external service providing SANE data, comma-separated list of URIs")
+	clientCerts        = flag.String("client-certs", "", "path to a json file listing client certificates per domain (default: ~/.sane/clients.json if present)")
+	signerSocket       = flag.String("signer", "", "unix socket of an external CA signer started with `sane signer`, the CA private key is not loaded")
+	permitTLDs         = flag.String("permit-tlds", "", "comma-separated list of handshake tlds generated CAs are limited to, instead of excluding ICANN tlds with -skip-icann")
+	issuanceLog        = flag.Bool("issuance-log", false, "record every minted certificate in ~/.sane/issued.jsonl")
+	cacheMinTTL        = flag.Duration("cache-min-ttl", 10*time.Second, "minimum time dns answers are cached")
+	cacheMaxTTL        = flag.Duration("cache-max-ttl", 3*time.Hour, "maximum time dns answers are cached")
+	cacheNegativeTTL   = flag.Duration("cache-negative-ttl", time.Hour, "maximum time negative dns answers are cached")
+	serveStale         = flag.Duration("serve-stale", 24*time.Hour, "how long expired dns answers are served when resolvers fail, 0 disables it")
+	ednsSize           = flag.Uint("edns-size", 1232, "EDNS UDP buffer size advertised to resolvers, truncated answers are retried over TCP")
+	randomize0x20      = flag.Bool("0x20", false, "randomize the case of names asked to udp resolvers and require answers to echo it")
+	hnsdResolver       = flag.Bool("hnsd-resolver", false, "keep hnsd running and resolve names from its root zone to the authoritative servers with DNSSEC validation, -r is not used")
+	validate           = flag.Bool("validate", false, "validate DNSSEC locally from -anchor instead of trusting the resolver's AD bit")
+	tofu               = flag.Bool("tofu", false, "pin upstream keys on first use for handshake names without TLSA records")
+	dnsAddr            = flag.String("dns-addr", "", "host:port of a dns server answering over udp and tcp with the resolver of the proxy, e.g. 127.0.0.1:5353")
+	dotAddr            = flag.String("dot-addr", "", "host:port of a dns over tls server answering with the resolver of the proxy, needs -dot-cert and -dot-key")
+	dohAddr            = flag.String("doh-addr", "", "host:port of a dns over https server answering at /dns-query with the resolver of the proxy, needs -dot-cert and -dot-key")
+	dotCert            = flag.String("dot-cert", "", "filepath to the certificate of the dns over tls and https servers")
+	dotKey             = flag.String("dot-key", "", "filepath to the private key of the dns over tls and https servers")
 )
 
 func getConfPath() string {
@@ -68,45 +92,22 @@ func getConfPath() string {
 	return p
 }
 
-func getOrCreateCA() (string, string) {
+func getOrCreateCA(constraints map[string]struct{}) (string, string) {
 	if *certPath != "" && *keyPath != "" {
 		return *certPath, *keyPath
 	}
-	p := getConfPath()
-	certPath := path.Join(p, "cert.crt")
-	keyPath := path.Join(p, "cert.key")
+	certPath, keyPath := caFiles(caCurrent)
 
 	if _, err := os.Stat(certPath); err != nil {
 		if _, err := os.Stat(keyPath); err != nil {
-			ca, priv, err := sane.NewAuthority("Stateless DANE", "Stateless DANE", 365*24*time.Hour, tld.NameConstraints)
+			ca, priv, err := newCA(caName, caValidity, constraints)
 			if err != nil {
 				log.Fatalf("couldn't generate CA: %v", err)
 			}
 
-			certOut, err := os.OpenFile(certPath, os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				log.Fatalf("couldn't create CA file: %v", err)
-			}
-			defer certOut.Close()
-
-			pem.Encode(certOut, &pem.Block{
-				Type:  "CERTIFICATE",
-				Bytes: ca.Raw,
-			})
-
-			privOut := bytes.NewBuffer([]byte{})
-			pem.Encode(privOut, &pem.Block{
-				Type:  "RSA PRIVATE KEY",
-				Bytes: x509.MarshalPKCS1PrivateKey(priv),
-			})
-
-			kOut, err := os.OpenFile(keyPath, os.O_CREATE|os.O_WRONLY, 0600)
-			if err != nil {
-				log.Fatalf("couldn't create CA private key file: %v", err)
+			if err := writeCA(certPath, keyPath, ca, priv); err != nil {
+				log.Fatal(err)
 			}
-			defer kOut.Close()
-
-			kOut.Write(privOut.Bytes())
 			return certPath, keyPath
 		}
 	}
@@ -119,42 +120,30 @@ func loadX509KeyPair(certFile, keyFile string) (tls.Certificate, error) {
 		return tls.Certificate{}, err
 	}
 
-	keyPEMBlock, err := os.ReadFile(keyFile)
+	keyPEMBlock, err := readKey(keyFile)
 	if err != nil {
 		return tls.Certificate{}, err
 	}
 
-	block, _ := pem.Decode(keyPEMBlock)
-	var decryptedBlock []byte
-
-	if x509.IsEncryptedPEMBlock(block) {
-		if *pass == "" {
-			*pass = os.Getenv("DANE_CA_PASS")
-		}
-
-		decryptedBlock, err = x509.DecryptPEMBlock(block, []byte(*pass))
-		if err != nil {
-			log.Fatalf("decryption failed: %v", err)
-		}
-	} else {
-		decryptedBlock = keyPEMBlock
-	}
-
-	return tls.X509KeyPair(certPEMBlock, decryptedBlock)
+	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
 }
 
-func loadCA() (*x509.Certificate, interface{}) {
+func loadCA(constraints map[string]struct{}) (*x509.Certificate, crypto.Signer) {
 	var x509c *x509.Certificate
-	var priv interface{}
+	var priv crypto.Signer
+
+	if *signerSocket != "" {
+		return loadSignerCA()
+	}
 
-	*certPath, *keyPath = getOrCreateCA()
+	*certPath, *keyPath = getOrCreateCA(constraints)
 	if *certPath != "" && *keyPath != "" {
 		cert, err := loadX509KeyPair(*certPath, *keyPath)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		priv = cert.PrivateKey
+		priv = cert.PrivateKey.(crypto.Signer)
 		x509c, err = x509.ParseCertificate(cert.Certificate[0])
 		if err != nil {
 			log.Fatal(err)
@@ -166,6 +155,93 @@ func loadCA() (*x509.Certificate, interface{}) {
 	return nil, nil
 }
 
+// loadClientIdentities loads client certificates from -client-certs
+// or from the conf dir if the default file exists.
+func loadClientIdentities(confPath string) (*sane.ClientIdentities, error) {
+	p := *clientCerts
+	if p == "" {
+		p = path.Join(confPath, "clients.json")
+		if _, err := os.Stat(p); err != nil {
+			return nil, nil
+		}
+	}
+
+	return sane.LoadClientIdentities(p)
+}
+
+// loadSignerCA loads the CA certificate and connects to the external signer holding its key.
+func loadSignerCA() (*x509.Certificate, crypto.Signer) {
+	p := *certPath
+	if p == "" {
+		p, _ = caFiles(caCurrent)
+	}
+	*certPath = p
+
+	ca, err := readCert(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return ca, dialSigner(ca)
+}
+
+// dialSigner connects to the external signer holding the private key of ca.
+func dialSigner(ca *x509.Certificate) crypto.Signer {
+	s, err := signer.Dial(*signerSocket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pub, ok := ca.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(s.Public()) {
+		log.Fatalf("signer key does not match the CA `%s`", ca.Subject.CommonName)
+	}
+
+	return s
+}
+
+// loadIssuer returns the CA issuing minted certificates, its private key and the
+// chain sent after minted certificates. If an intermediate CA was issued it signs
+// the certificates and the root private key is not needed.
+func loadIssuer(constraints map[string]struct{}) (*x509.Certificate, crypto.Signer, []*x509.Certificate) {
+	interCert, interKey := caFiles(caIntermediate)
+	if _, err := os.Stat(interCert); err != nil {
+		ca, priv := loadCA(constraints)
+		return ca, priv, loadCAChain(ca)
+	}
+
+	if *certPath == "" {
+		*certPath, _ = caFiles(caCurrent)
+	}
+	root, err := readCert(*certPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var inter *x509.Certificate
+	var priv crypto.Signer
+	if *signerSocket != "" {
+		if inter, err = readCert(interCert); err != nil {
+			log.Fatal(err)
+		}
+		priv = dialSigner(inter)
+	} else {
+		cert, err := loadX509KeyPair(interCert, interKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		priv = cert.PrivateKey.(crypto.Signer)
+		if inter, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := inter.CheckSignatureFrom(root); err != nil {
+		log.Fatalf("intermediate CA in %s is not issued by the root CA in %s: %v", interCert, *certPath, err)
+	}
+	warnCAExpiry(root)
+
+	return inter, priv, append([]*x509.Certificate{inter}, loadCAChain(root)...)
+}
+
 func isLoopback(r string) bool {
 	var ip net.IP
 	host, _, err := net.SplitHostPort(r)
@@ -204,6 +280,29 @@ func splitHostPortKey(addr string) (hostport string, key *hsig0.PublicKey, err e
 	return
 }
 
+// parseUpstreams parses a comma-separated list of resolvers,
+// each optionally prefixed with a SIG(0) key as key@host:port.
+func parseUpstreams(list string) ([]rs.Upstream, error) {
+	var upstreams []rs.Upstream
+	for _, addr := range strings.Split(list, ",") {
+		hostport, key, err := splitHostPortKey(addr)
+		switch err {
+		case errNoKey:
+			upstreams = append(upstreams, rs.Upstream{Addr: strings.TrimSpace(addr)})
+		case nil:
+			upstreams = append(upstreams, rs.Upstream{
+				Addr: hostport,
+				Verify: func(m *dns.Msg) error {
+					return hsig0.Verify(m, key)
+				},
+			})
+		default:
+			return nil, err
+		}
+	}
+	return upstreams, nil
+}
+
 func main() {
 
 	flag.Parse()
@@ -212,6 +311,14 @@ func main() {
 		fmt.Printf("Version %s\n", sane.Version)
 		return
 	}
+	loadTLDs(p)
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	services := strings.Split(*externalService, ",")
 
@@ -219,65 +326,177 @@ func main() {
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 	}
 
-	if *hnsdPath == "" {
+	var hsdClient *hsd.Client
+	if *hsdURL != "" {
+		if *hnsdResolver {
+			log.Fatal("-hnsd-resolver can't be used with -hsd")
+		}
+		c, err := hsd.NewClient(*hsdURL, *hsdAPIKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hsdClient = c
+	} else if *hnsdPath == "" {
 		log.Fatal("path to hnsd is not provided")
 	}
 
-	ctx := context.Background()
-	sync.GetRoots(ctx, *hnsdPath, p, *hnsdCheckpointPath)
-	go func() {
-		for {
-			time.Sleep(*resyncInterval)
-			sync.GetRoots(ctx, *hnsdPath, p, *hnsdCheckpointPath)
+	if *hnsdResolver && *validate {
+		log.Fatal("-validate can't be used with -hnsd-resolver, which always validates")
+	}
+	if *recursive && (*validate || *hnsdResolver) {
+		log.Fatal("-recursive can't be used with -validate or -hnsd-resolver")
+	}
+	if *unboundConf != "" && !*recursive {
+		log.Fatal("-unbound-conf needs -recursive")
+	}
+	if *ednsSize < dns.MinMsgSize || *ednsSize > dns.MaxMsgSize {
+		log.Fatalf("-edns-size must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize)
+	}
+
+	var ub *rs.Recursive
+	if *recursive {
+		r, err := newRecursive()
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+		// the unbound context is used until the process exits
+		ub = r
+	}
 
-	if !*skipICANN {
-		tld.NameConstraints = nil
+	ctx := context.Background()
+	var hnsResolver rs.Resolver
+	if hsdClient != nil {
+		hnsResolver = useHSD(ctx, hsdClient, p)
+	} else if *hnsdResolver {
+		sync.RunHNSD(ctx, *hnsdPath, p, *hnsdCheckpointPath)
+	} else {
+		sync.GetRoots(ctx, *hnsdPath, p, *hnsdCheckpointPath)
+		go func() {
+			for {
+				time.Sleep(*resyncInterval)
+				sync.GetRoots(ctx, *hnsdPath, p, *hnsdCheckpointPath)
+			}
+		}()
 	}
 
-	ca, priv := loadCA()
+	constraints := caConstraints()
+	ca, priv, chain := loadIssuer(constraints)
 	if *output != "" {
 		exportCA()
 		return
 	}
+	warnCAExpiry(ca)
+	warnCAConstraints(ca)
+	go func() {
+		for {
+			time.Sleep(24 * time.Hour)
+			warnCAExpiry(ca)
+		}
+	}()
 
 	var resolver rs.Resolver
-	var sig0 bool
-
-	hostport, key, err := splitHostPortKey(*raddr)
-	switch err {
-	case errNoKey:
-		sig0 = false
-	case nil:
-		sig0 = true
-		*raddr = hostport
-	default:
+
+	upstreams, err := parseUpstreams(*raddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	strategy, err := rs.ParseStrategy(*resolverStrategy)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	ad, err := rs.NewStub(*raddr)
+	ad, err := rs.NewStubUpstreams(upstreams, strategy)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if sig0 {
-		ad.Verify = func(m *dns.Msg) error {
-			return hsig0.Verify(m, key)
+	ad.MinTTL = *cacheMinTTL
+	ad.MaxTTL = *cacheMaxTTL
+	ad.NegativeTTL = *cacheNegativeTTL
+	ad.StaleTTL = *serveStale
+	ad.UDPSize = uint16(*ednsSize)
+	ad.Randomize0x20 = *randomize0x20
+	resolver = ad
+
+	if *validate {
+		v := rs.NewValidating(ad)
+		if *anchor != "" {
+			err = v.AddTAFile(*anchor)
+		} else {
+			err = v.AddTA(KSK2017)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		resolver = v
+	}
+
+	if *hnsdResolver {
+		if resolver, err = rs.NewHNSD(sync.RootServer); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if ub != nil {
+		resolver = ub
+	}
+
+	// handshake names are resolved by hsd
+	if hnsResolver != nil {
+		resolver = &splitResolver{icann: resolver, hns: hnsResolver}
+	}
+
+	if *verbose {
+		go func() {
+			for {
+				time.Sleep(time.Hour)
+				st := ad.CacheStats()
+				log.Printf("[INFO] dns cache: %d entries, %d hits, %d misses, %d stale, %d prefetches, %d evictions",
+					st.Entries, st.Hits, st.Misses, st.Stale, st.Prefetches, st.Evictions)
+			}
+		}()
+	}
+
+	var pins *sane.PinStore
+	if *tofu {
+		pins, err = sane.NewPinStore(path.Join(p, pinsFileName))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	clientIDs, err := loadClientIdentities(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var issued *sane.IssuanceLog
+	if *issuanceLog {
+		issued, err = sane.OpenIssuanceLog(path.Join(p, issuanceLogFileName))
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
-	resolver = ad
 
 	c := &sane.Config{
-		Certificate:     ca,
-		PrivateKey:      priv,
-		Validity:        *validity,
-		Resolver:        resolver,
-		Constraints:     tld.NameConstraints,
-		SkipNameChecks:  *skipNameChecks,
-		Verbose:         *verbose,
-		RootsPath:       path.Join(p, "roots.json"),
-		ExternalService: services,
+		Certificate:      ca,
+		PrivateKey:       priv,
+		Validity:         *validity,
+		Resolver:         resolver,
+		Constraints:      constraints,
+		SkipNameChecks:   *skipNameChecks,
+		Verbose:          *verbose,
+		RootsPath:        path.Join(p, "roots.json"),
+		ExternalService:  services,
+		CAChain:          chain,
+		Pins:             pins,
+		ClientIdentities: clientIDs,
+		IssuanceLog:      issued,
+		ContentHandler:   dohHandler(resolver),
+	}
+	if err := serveDNS(resolver); err != nil {
+		log.Fatal(err)
 	}
+
 	log.Printf("Listening on %s", *addr)
 	log.Fatal(c.Run(*addr))
 }
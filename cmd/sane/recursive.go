@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	rs "github.com/randomlogin/sane/resolver"
+)
+
+// newRecursive creates the unbound recursive resolver, anchored at -anchor
+// and forwarding to the resolvers given with -r if any.
+func newRecursive() (*rs.Recursive, error) {
+	r, err := rs.NewRecursive()
+	if errors.Is(err, rs.ErrUnboundNotAvail) {
+		return nil, errors.New("-recursive needs unbound support, rebuild sane with `go build -tags unbound` (requires libunbound)")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := configureRecursive(r); err != nil {
+		r.Destroy()
+		return nil, err
+	}
+	return r, nil
+}
+
+func configureRecursive(r *rs.Recursive) error {
+	if *unboundConf != "" {
+		if err := r.Config(*unboundConf); err != nil {
+			return fmt.Errorf("failed to load unbound config %s: %v", *unboundConf, err)
+		}
+	}
+
+	if *anchor != "" {
+		if err := r.AddTAFile(*anchor); err != nil {
+			return fmt.Errorf("failed to load trust anchor %s: %v", *anchor, err)
+		}
+	} else if err := r.AddTA(KSK2017); err != nil {
+		return fmt.Errorf("failed to add trust anchor: %v", err)
+	}
+
+	if *raddr == "" {
+		return nil
+	}
+	for _, addr := range strings.Split(*raddr, ",") {
+		fwd, err := unboundForwarder(strings.TrimSpace(addr))
+		if err != nil {
+			return err
+		}
+		if err := r.SetFwd(fwd); err != nil {
+			return fmt.Errorf("failed to forward to %s: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// unboundForwarder converts a -r resolver into the ip@port form unbound
+// forwards to, only plain dns servers are supported.
+func unboundForwarder(addr string) (string, error) {
+	addr = strings.TrimPrefix(addr, "udp://")
+	if strings.Contains(addr, "://") || strings.Contains(addr, "@") {
+		return "", fmt.Errorf("-recursive can only forward to plain dns servers given as ip or ip:port, got %s", addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = strings.Trim(addr, "[]"), "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("-recursive forwarder must be an ip address, got %s", addr)
+	}
+	return host + "@" + port, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/randomlogin/sane/signer"
+)
+
+// signerCommand runs a signer process holding the CA private key.
+func signerCommand(args []string) error {
+	fs := flag.NewFlagSet("signer", flag.ContinueOnError)
+	socket := fs.String("socket", "", "unix socket to listen on")
+	permit := fs.String("permit", "", "comma-separated list of domains certificates may be issued for (default: any)")
+	allowDigest := fs.Bool("allow-digest", false, "allow signing raw digests, this bypasses -permit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *socket == "" {
+		return errors.New("signer: -socket is required")
+	}
+	if *allowDigest && *permit != "" {
+		return errors.New("signer: -allow-digest cannot be used with -permit")
+	}
+
+	ca, priv, _ := loadIssuer(caConstraints())
+	s := &signer.Server{
+		Signer:      priv,
+		Issuer:      ca,
+		AllowDigest: *allowDigest,
+	}
+	if *permit != "" {
+		s.Policy = signer.PermitDomains(strings.Split(*permit, ","))
+	}
+
+	log.Printf("signer listening on %s", *socket)
+	return s.ListenAndServe(*socket)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/randomlogin/sane/tld"
+)
+
+const tldsFileName = "tlds.txt"
+
+// loadTLDs loads the ICANN tld list imported with `sane tld update`,
+// the embedded list is used if there is none.
+func loadTLDs(confPath string) {
+	p := path.Join(confPath, tldsFileName)
+	tlds, err := tld.ReadFile(p)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("[WARN] couldn't load tld list %s, using the embedded one: %v", p, err)
+		return
+	}
+	tld.Set(tlds)
+}
+
+func tldCommand(args []string) error {
+	if len(args) == 0 || args[0] != "update" {
+		return errUsage
+	}
+
+	fs := flag.NewFlagSet("tld update", flag.ContinueOnError)
+	from := fs.String("from", "", "path to a tld list in the IANA format (tlds-alpha-by-domain.txt)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *from == "" {
+		return errUsage
+	}
+
+	b, err := os.ReadFile(*from)
+	if err != nil {
+		return err
+	}
+	tlds, err := tld.Parse(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("couldn't parse %s: %v", *from, err)
+	}
+
+	added, removed := diffTLDs(tld.ICANN(), tlds)
+	if err := os.WriteFile(path.Join(getConfPath(), tldsFileName), b, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("imported %d tlds, %d added, %d removed\n", len(tlds), len(added), len(removed))
+
+	// name constraints are part of the CA certificate, new tlds
+	// are only excluded by CAs issued from now on
+	caCert, _ := caFiles(caCurrent)
+	if ca, err := readCert(caCert); err == nil && len(ca.ExcludedDNSDomains) > 0 {
+		if missing := unexcludedTLDs(ca, tlds); len(missing) > 0 {
+			fmt.Printf("the CA does not exclude %d of these tlds, run `sane ca rotate` to issue a CA constraining them\n", len(missing))
+		}
+	}
+	return nil
+}
+
+// unexcludedTLDs returns the tlds not excluded by the name constraints of ca.
+func unexcludedTLDs(ca *x509.Certificate, tlds map[string]struct{}) []string {
+	excluded := make(map[string]struct{})
+	for _, d := range ca.ExcludedDNSDomains {
+		// constraints are stored as ".tld"
+		excluded[strings.TrimPrefix(d, ".")] = struct{}{}
+	}
+	missing, _ := diffTLDs(excluded, tlds)
+	return missing
+}
+
+// diffTLDs returns the tlds added to and removed from old in new.
+func diffTLDs(old, new map[string]struct{}) (added, removed []string) {
+	for t := range new {
+		if _, ok := old[t]; !ok {
+			added = append(added, t)
+		}
+	}
+	for t := range old {
+		if _, ok := new[t]; !ok {
+			removed = append(removed, t)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	sane "github.com/randomlogin/sane"
+)
+
+func TestUnexcludedTLDs(t *testing.T) {
+	ca, _, err := sane.NewAuthority("test", "test", time.Hour, map[string]struct{}{"com": {}, "net": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tlds []string
+		want []string
+	}{
+		{[]string{"com", "net"}, nil},
+		{[]string{"com"}, nil},
+		{[]string{"com", "net", "org"}, []string{"org"}},
+	}
+	for _, tt := range tests {
+		tlds := make(map[string]struct{})
+		for _, t := range tt.tlds {
+			tlds[t] = struct{}{}
+		}
+		if got := unexcludedTLDs(ca, tlds); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.tlds, got, tt.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -24,6 +25,13 @@ type addrList struct {
 	Host string
 	Port string
 	IPs  []net.IP
+	// Base is the TLSA base domain (RFC 7671 section 7), it is
+	// the target of the CNAME chain of Host if TLSA records were found there.
+	Base string
+	// HTTPS are the service mode HTTPS records of the host
+	// sorted by priority, HTTPSSecure tells whether they are secure.
+	HTTPS       []*dns.HTTPS
+	HTTPSSecure bool
 }
 
 func newDialer() *dialer {
@@ -36,27 +44,113 @@ func newDialer() *dialer {
 }
 
 // dialTLSContext attempts to connect to one of the dst addresses and initiates a TLS
-// handshake, returning the resulting TLS connection.
+// handshake, returning the resulting TLS connection. The endpoints of the HTTPS
+// records of dst are tried first.
 func (d *dialer) dialTLSContext(ctx context.Context, network string, dst *addrList, config *tls.Config) (*tls.Conn, error) {
-	tlsDialer := &tls.Dialer{
-		NetDialer: &d.net,
-		Config:    config,
+	endpoints := d.endpoints(ctx, dst)
+
+	ech := len(endpoints) > 0
+	for _, e := range endpoints {
+		ech = ech && e.ech != nil
+		conn, err := d.dialEndpoint(ctx, network, e, config)
+		if err == nil {
+			return conn, nil
+		}
+		if err, ok := err.(*tlsError); ok {
+			return nil, err
+		}
 	}
 
-	for _, ip := range dst.IPs {
-		ipaddr := net.JoinHostPort(ip.String(), dst.Port)
-		conn, err := tlsDialer.DialContext(ctx, network, ipaddr)
-		if err != nil {
+	// falling back to the origin would leak the server name (RFC 9460 section 8.1)
+	if ech {
+		return nil, fmt.Errorf("could not reach any ech endpoint of %s", dst.Host)
+	}
+	return d.dialEndpoint(ctx, network, &endpoint{port: dst.Port, ips: dst.IPs}, config)
+}
+
+// dialEndpoint attempts to connect to one of the endpoint addresses and initiates
+// a TLS handshake with the ALPN and ECH parameters of the endpoint.
+func (d *dialer) dialEndpoint(ctx context.Context, network string, e *endpoint, config *tls.Config) (*tls.Conn, error) {
+	config = config.Clone()
+	if len(e.alpn) > 0 && len(config.NextProtos) > 0 {
+		if config.NextProtos = e.protos(config.NextProtos); len(config.NextProtos) == 0 {
+			return nil, fmt.Errorf("no common alpn with %v", e.alpn)
+		}
+	}
+	if e.ech != nil {
+		config.EncryptedClientHelloConfigList = e.ech
+		// the certificates aren't passed to this callback, the public
+		// name is verified once the rejection is returned instead
+		config.EncryptedClientHelloRejectionVerify = func(tls.ConnectionState) error { return nil }
+		config.MinVersion = tls.VersionTLS13
+	}
+
+	for _, ip := range e.ips {
+		ipaddr := net.JoinHostPort(ip.String(), e.port)
+		conn, err := d.handshake(ctx, network, ipaddr, config)
 
+		// retry once with the configs sent by the server, they are
+		// only trusted from a server authenticated for the public name
+		var rejected *tls.ECHRejectionError
+		if errors.As(err, &rejected) {
+			if verr := d.verifyPublicName(ctx, network, e.port, conn.ConnectionState()); verr != nil {
+				err = verr
+			} else if len(rejected.RetryConfigList) > 0 {
+				retry := config.Clone()
+				retry.EncryptedClientHelloConfigList = rejected.RetryConfigList
+				conn, err = d.handshake(ctx, network, ipaddr, retry)
+			}
+		}
+		if err != nil {
 			if err, ok := err.(*tlsError); ok {
 				return nil, err
 			}
 			continue
 		}
-		return conn.(*tls.Conn), nil
+		return conn, nil
 	}
 
-	return nil, fmt.Errorf("could not reach any of %v", dst.IPs)
+	return nil, fmt.Errorf("could not reach any of %v", e.ips)
+}
+
+// handshake connects to addr and initiates a TLS handshake, the connection is
+// returned along with a handshake error for the state of the failed handshake.
+func (d *dialer) handshake(ctx context.Context, network, addr string, config *tls.Config) (*tls.Conn, error) {
+	if d.net.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.net.Timeout)
+		defer cancel()
+	}
+
+	raw, err := d.net.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return conn, err
+	}
+	return conn, nil
+}
+
+// verifyPublicName verifies the certificate for the ECH public name a server
+// presented when it rejected ECH against the secure TLSA records of the name.
+func (d *dialer) verifyPublicName(ctx context.Context, network, port string, cs tls.ConnectionState) error {
+	name := strings.TrimSuffix(cs.ServerName, ".")
+	if len(cs.PeerCertificates) == 0 {
+		return &tlsError{err: fmt.Sprintf("tls: no certificate for ech public name %s", name)}
+	}
+	tlsa, _, err := d.lookupTLSA(ctx, network, name, port)
+	if err != nil {
+		return &tlsError{err: fmt.Sprintf("tls: ech public name %s: %v", name, err)}
+	}
+	for _, t := range tlsa {
+		if t.Usage == 3 && t.Verify(cs.PeerCertificates[0]) == nil {
+			return nil
+		}
+	}
+	return &tlsError{err: fmt.Sprintf("tls: dane authentication of ech public name %s failed", name)}
 }
 
 // dialContext attempts to connect to the given named address.
@@ -112,27 +206,29 @@ func (d *dialer) resolveDANE(ctx context.Context, network, host string, constrai
 	if err != nil || addrs.Host == "" || addrs.Port == "" {
 		return nil, nil, errBadHost
 	}
+	addrs.Base = addrs.Host
 	if ip := net.ParseIP(addrs.Host); ip != nil {
 		addrs.IPs = []net.IP{ip}
 		return
 	}
 
-	done := make(chan struct{})
+	done := make(chan struct{}, 2)
 	var tlsaErr, ipErr error
 
 	go func() {
 		addrs.IPs, _, ipErr = d.resolver.LookupIP(ctx, "ip", addrs.Host)
 		done <- struct{}{}
 	}()
+	go func() {
+		addrs.HTTPS, addrs.HTTPSSecure = d.lookupHTTPS(ctx, addrs.Host, addrs.Port)
+		done <- struct{}{}
+	}()
 
 	if constraints == nil || !inConstraints(constraints, addrs.Host) {
-		var secure bool
-		tlsa, secure, tlsaErr = d.resolver.LookupTLSA(ctx, addrs.Port, network, addrs.Host)
-		if !secure {
-			tlsa = []*dns.TLSA{}
-		}
+		tlsa, addrs.Base, tlsaErr = d.lookupTLSA(ctx, network, addrs.Host, addrs.Port)
 	}
 	<-done
+	<-done
 
 	if ipErr != nil {
 		err = ipErr
@@ -143,6 +239,26 @@ func (d *dialer) resolveDANE(ctx context.Context, network, host string, constrai
 	return
 }
 
+// lookupTLSA looks up the secure TLSA records of host at the target of its secure CNAME
+// chain first and at host itself otherwise (RFC 7671 section 7). It returns the
+// records and the TLSA base domain they were found at.
+func (d *dialer) lookupTLSA(ctx context.Context, network, host, port string) ([]*dns.TLSA, string, error) {
+	target, secure, err := d.resolver.LookupCNAME(ctx, host)
+	if err == nil && secure && !strings.EqualFold(target, dns.Fqdn(host)) {
+		target = strings.TrimSuffix(target, ".")
+		tlsa, secure, err := d.resolver.LookupTLSA(ctx, port, network, target)
+		if err == nil && secure && tlsaSupported(tlsa) {
+			return tlsa, target, nil
+		}
+	}
+
+	tlsa, secure, err := d.resolver.LookupTLSA(ctx, port, network, host)
+	if !secure {
+		tlsa = []*dns.TLSA{}
+	}
+	return tlsa, host, err
+}
+
 // httpOnlyRoundTripper creates a round tripper used for http requests (fails on https requests)
 func httpOnlyRoundTripper(d *dialer) http.RoundTripper {
 	return &http.Transport{
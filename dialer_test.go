@@ -9,6 +9,8 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func TestDialTLS(t *testing.T) {
@@ -28,7 +30,7 @@ func TestDialTLS(t *testing.T) {
 	addrs.IPs = []net.IP{net.ParseIP("255.255.255.255"), net.ParseIP(ip)}
 
 	tlsa := newTLSA(3, 1, 1, srv.Certificate())
-	config := newTLSConfig("", tlsa, false, nil, nil)
+	config := newTLSConfig("", tlsa, false, nil, nil, nil)
 
 	conn, err := d.dialTLSContext(context.Background(), "tcp", addrs, config)
 	if err != nil {
@@ -52,3 +54,104 @@ func TestDialTLS(t *testing.T) {
 		t.Fatalf("body = '%s', wanted 'foo'", c)
 	}
 }
+
+func TestEndpoints(t *testing.T) {
+	zone := map[string]string{
+		"_8443._https.example.com.": `_8443._https.example.com. 300 IN HTTPS 0 svc.example.net.`,
+		"svc.example.net.": `svc.example.net. 300 IN HTTPS 2 . alpn=h2 ipv4hint=192.0.2.2
+svc.example.net. 300 IN HTTPS 1 alt.example.net. port=9443 alpn=h2 no-default-alpn echconfig=AAEC`,
+	}
+	ips := map[string][]net.IP{
+		"alt.example.net": {net.ParseIP("192.0.2.1")},
+	}
+
+	for _, secure := range []bool{true, false} {
+		d := newDialer()
+		d.resolver = &testResolver{
+			lookupIP: func(ctx context.Context, network, host string) ([]net.IP, bool, error) {
+				return ips[strings.TrimSuffix(host, ".")], secure, nil
+			},
+			lookupHTTPS: func(ctx context.Context, name string) ([]*dns.HTTPS, bool, error) {
+				var rrs []*dns.HTTPS
+				for _, line := range strings.Split(zone[name], "\n") {
+					if line == "" {
+						continue
+					}
+					rr, err := dns.NewRR(line)
+					if err != nil {
+						t.Fatal(err)
+					}
+					rrs = append(rrs, rr.(*dns.HTTPS))
+				}
+				return rrs, secure, nil
+			},
+		}
+
+		addrs := &addrList{Host: "example.com", Port: "8443", IPs: []net.IP{net.ParseIP("192.0.2.9")}}
+		addrs.HTTPS, addrs.HTTPSSecure = d.lookupHTTPS(context.Background(), addrs.Host, addrs.Port)
+		if addrs.HTTPSSecure != secure {
+			t.Fatalf("got secure %v, want %v", addrs.HTTPSSecure, secure)
+		}
+
+		got := d.endpoints(context.Background(), addrs)
+		if len(got) != 2 {
+			t.Fatalf("got %d endpoints, want 2", len(got))
+		}
+		if got[0].port != "9443" || !got[0].ips[0].Equal(ips["alt.example.net"][0]) {
+			t.Fatalf("got endpoint %s %v, want 9443 %v", got[0].port, got[0].ips, ips["alt.example.net"])
+		}
+		if p := got[0].protos([]string{"http/1.1", "h2"}); len(p) != 1 || p[0] != "h2" {
+			t.Fatalf("got protos %v, want [h2]", p)
+		}
+		if (got[0].ech != nil) != secure {
+			t.Fatalf("got ech %v, want ech only for secure records", got[0].ech)
+		}
+		if got[1].port != "8443" || !got[1].ips[0].Equal(net.ParseIP("192.0.2.2")) {
+			t.Fatalf("got endpoint %s %v, want 8443 [192.0.2.2]", got[1].port, got[1].ips)
+		}
+		if p := got[1].protos([]string{"http/1.1", "h2"}); len(p) != 2 {
+			t.Fatalf("got protos %v, want [http/1.1 h2]", p)
+		}
+	}
+}
+
+func TestLookupTLSABase(t *testing.T) {
+	tlsa := newTLSA(3, 1, 1, "31EF2A4D6E285CC29A636C5171F7DA0AC69CC44CEBAF5CD039DA8CC81187482A")
+	tests := []struct {
+		name        string
+		cnameSecure bool
+		records     map[string]bool
+		want        string
+	}{
+		{"target", true, map[string]bool{"target.hoster": true, "site": true}, "target.hoster"},
+		{"fallback", true, map[string]bool{"site": true}, "site"},
+		{"insecure cname", false, map[string]bool{"target.hoster": true, "site": true}, "site"},
+		{"insecure target", true, map[string]bool{"target.hoster": false, "site": true}, "site"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newDialer()
+			d.resolver = &testResolver{
+				lookupCNAME: func(ctx context.Context, host string) (string, bool, error) {
+					return "target.hoster.", tc.cnameSecure, nil
+				},
+				lookupTLSA: func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
+					secure, ok := tc.records[name]
+					if !ok {
+						return nil, true, nil
+					}
+					return tlsa, secure, nil
+				},
+			}
+
+			rrs, base, err := d.lookupTLSA(context.Background(), "tcp", "site", "443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if base != tc.want || len(rrs) != 1 {
+				t.Fatalf("got base %s with %d records, want %s with 1", base, len(rrs), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+//go:build go1.24
+
+package sane
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// newECHConfig returns an ECHConfig (RFC 9849 section 4) for publicName
+// using DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-128-GCM.
+func newECHConfig(t *testing.T, id uint8, publicName string) ([]byte, *ecdh.PrivateKey) {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16(0xfe0d)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(id)
+		b.AddUint16(0x0020)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(key.PublicKey().Bytes())
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x0001)
+			b.AddUint16(0x0001)
+		})
+		b.AddUint8(0)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0)
+	})
+	return b.BytesOrPanic(), key
+}
+
+func TestDialECHRejected(t *testing.T) {
+	config, key := newECHConfig(t, 1, "public.example")
+	stale, _ := newECHConfig(t, 2, "public.example")
+
+	// the server only knows the current config and sends it as retry config
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {}))
+	srv.TLS = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{
+		{Config: config, PrivateKey: key.Bytes(), SendAsRetry: true},
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	ip, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	// the client has a stale config list from dns
+	var list cryptobyte.Builder
+	list.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(stale) })
+	e := &endpoint{port: port, ips: []net.IP{net.ParseIP(ip)}, ech: list.BytesOrPanic()}
+
+	tests := []struct {
+		name   string
+		tlsa   []*dns.TLSA
+		secure bool
+		want   bool
+	}{
+		{"dane public name", newTLSA(3, 1, 1, srv.Certificate()), true, true},
+		{"insecure public name", newTLSA(3, 1, 1, srv.Certificate()), false, false},
+		{"no tlsa", nil, true, false},
+	}
+	for _, tt := range tests {
+		d := newDialer()
+		d.resolver = &testResolver{
+			lookupTLSA: func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
+				if name != "public.example" || service != port {
+					return nil, false, errors.New("unexpected tlsa lookup " + service + " " + name)
+				}
+				return tt.tlsa, tt.secure, nil
+			},
+		}
+		// the origin is accepted, only the public name is checked here
+		origin := &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "example.com",
+			VerifyConnection:   func(cs tls.ConnectionState) error { return nil },
+		}
+
+		conn, err := d.dialEndpoint(context.Background(), "tcp", e, origin)
+		if !tt.want {
+			if _, ok := err.(*tlsError); !ok {
+				t.Errorf("%s: got %v, want a tls error", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: got %v, want no error", tt.name, err)
+		}
+		if !conn.ConnectionState().ECHAccepted {
+			t.Errorf("%s: got ech rejected, want ech accepted with the retry configs", tt.name)
+		}
+		conn.Close()
+	}
+}
@@ -1,17 +1,26 @@
 module github.com/randomlogin/sane
 
-go 1.21
+go 1.23
 
 require (
 	github.com/buffrr/hsig0 v0.0.0-20200928223456-eca10c3b5481
 	github.com/miekg/dns v1.1.43
 	github.com/miekg/unbound v0.0.0-20180419064740-e2b53b2dbcba
 	github.com/nodech/go-hsd-utils v0.0.1
+	github.com/quic-go/quic-go v0.42.0
 	golang.org/x/crypto v0.16.0
 	golang.org/x/sys v0.22.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
 
 require (
 	github.com/decred/dcrd/dcrec/secp256k1/v3 v3.0.0 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.11.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
 )
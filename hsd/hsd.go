@@ -0,0 +1,294 @@
+// Package hsd is a JSON-RPC client of an hsd full node, used to
+// resolve Handshake TLDs, fetch urkel proofs and read tree roots.
+package hsd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nodech/go-hsd-utils/proof"
+	"github.com/randomlogin/sane/sync"
+)
+
+const (
+	timeout = 10 * time.Second
+	// TreeInterval is the number of blocks between tree commitments on mainnet.
+	TreeInterval = 36
+	// ttl of the records synthesized from name resources
+	resourceTTL = 21600
+)
+
+// Client calls the JSON-RPC interface of an hsd node.
+type Client struct {
+	url    string
+	apiKey string
+	http   *http.Client
+}
+
+// NewClient creates a client for the hsd node listening at rawURL (the
+// node's http port, 12037 on mainnet). The API key may also be given as
+// the password of the URL.
+func NewClient(rawURL, apiKey string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("hsd: bad url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("hsd: unsupported scheme %q", u.Scheme)
+	}
+	if p, ok := u.User.Password(); ok && apiKey == "" {
+		apiKey = p
+	}
+	u.User = nil
+
+	return &Client{
+		url:    u.String(),
+		apiKey: apiKey,
+		http:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+type rpcRequest struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     int           `json:"id"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+type rpcError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("hsd: %s (code %d)", e.Message, e.Code)
+}
+
+func (c *Client) call(ctx context.Context, method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(rpcRequest{Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.SetBasicAuth("x", c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("hsd: %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("hsd: %s: unauthorized, check the api key", method)
+	}
+
+	var r rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("hsd: %s: bad response (status %s): %v", method, resp.Status, err)
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
+
+// Record is a record of a name resource.
+type Record struct {
+	Type       string   `json:"type"`
+	NS         string   `json:"ns,omitempty"`
+	Address    string   `json:"address,omitempty"`
+	KeyTag     uint16   `json:"keyTag,omitempty"`
+	Algorithm  uint8    `json:"algorithm,omitempty"`
+	DigestType uint8    `json:"digestType,omitempty"`
+	Digest     string   `json:"digest,omitempty"`
+	TXT        []string `json:"txt,omitempty"`
+}
+
+// Resource is the data a Handshake name commits to.
+type Resource struct {
+	Records []Record `json:"records"`
+}
+
+// NameResource returns the resource of a Handshake TLD,
+// nil if the name has none.
+func (c *Client) NameResource(ctx context.Context, name string) (*Resource, error) {
+	var res *Resource
+	if err := c.call(ctx, "getnameresource", &res, strings.TrimSuffix(name, ".")); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RRs returns the records of the resource of tld as DNS
+// records, the way the hsd root server serves them.
+func (r *Resource) RRs(tld string) []dns.RR {
+	tld = dns.Fqdn(tld)
+	hdr := func(name string, t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: t, Class: dns.ClassINET, Ttl: resourceTTL}
+	}
+	ns := func(host string) dns.RR {
+		return &dns.NS{Hdr: hdr(tld, dns.TypeNS), Ns: dns.Fqdn(host)}
+	}
+	glue := func(host, addr string) dns.RR {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &dns.A{Hdr: hdr(dns.Fqdn(host), dns.TypeA), A: ip4}
+		}
+		return &dns.AAAA{Hdr: hdr(dns.Fqdn(host), dns.TypeAAAA), AAAA: ip}
+	}
+
+	var rrs []dns.RR
+	for _, rec := range r.Records {
+		switch rec.Type {
+		case "NS":
+			rrs = append(rrs, ns(rec.NS))
+		case "GLUE4", "GLUE6":
+			rrs = append(rrs, ns(rec.NS))
+			if g := glue(rec.NS, rec.Address); g != nil {
+				rrs = append(rrs, g)
+			}
+		case "SYNTH4", "SYNTH6":
+			host := synthName(rec.Address)
+			if host == "" {
+				continue
+			}
+			rrs = append(rrs, ns(host), glue(host, rec.Address))
+		case "DS":
+			rrs = append(rrs, &dns.DS{
+				Hdr:        hdr(tld, dns.TypeDS),
+				KeyTag:     rec.KeyTag,
+				Algorithm:  rec.Algorithm,
+				DigestType: rec.DigestType,
+				Digest:     strings.ToUpper(rec.Digest),
+			})
+		case "TXT":
+			rrs = append(rrs, &dns.TXT{Hdr: hdr(tld, dns.TypeTXT), Txt: rec.TXT})
+		}
+	}
+	return rrs
+}
+
+var synthEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// synthName returns the name server name hsd synthesizes for addr.
+func synthName(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	raw := []byte(ip.To16())
+	if ip4 := ip.To4(); ip4 != nil {
+		raw = ip4
+	}
+	return "_" + strings.ToLower(synthEncoding.EncodeToString(raw)) + "._synth."
+}
+
+// NameProof is an urkel proof of a name against a tree root.
+type NameProof struct {
+	Hash   string          `json:"hash"`
+	Height uint32          `json:"height"`
+	Root   string          `json:"root"`
+	Name   string          `json:"name"`
+	Key    string          `json:"key"`
+	Proof  json.RawMessage `json:"proof"`
+}
+
+// NameProof returns the urkel proof of a Handshake TLD
+// against the latest tree root.
+func (c *Client) NameProof(ctx context.Context, name string) (*NameProof, error) {
+	var p NameProof
+	if err := c.call(ctx, "getnameproof", &p, strings.TrimSuffix(name, ".")); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Extension serializes the proof like the urkel certificate extension.
+func (p *NameProof) Extension() ([]byte, error) {
+	root, err := hex.DecodeString(p.Root)
+	if err != nil || len(root) != 32 {
+		return nil, errors.New("hsd: bad tree root in the name proof")
+	}
+
+	var up proof.Proof
+	if err := json.Unmarshal(p.Proof, &up); err != nil {
+		return nil, fmt.Errorf("hsd: bad name proof: %v", err)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(1)
+	buf.Write(root)
+	if err := up.Serialize(&buf); err != nil {
+		return nil, fmt.Errorf("hsd: bad name proof: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+type chainInfo struct {
+	Blocks uint32 `json:"blocks"`
+}
+
+type blockHeader struct {
+	Height   uint32 `json:"height"`
+	Time     uint64 `json:"time"`
+	TreeRoot string `json:"treeroot"`
+}
+
+// TreeRoots reads the last n tree roots from the block headers,
+// oldest first, one per tree interval.
+func (c *Client) TreeRoots(ctx context.Context, n int) ([]sync.BlockInfo, error) {
+	var info chainInfo
+	if err := c.call(ctx, "getblockchaininfo", &info); err != nil {
+		return nil, err
+	}
+
+	var roots []sync.BlockInfo
+	for h := int64(info.Blocks); h >= 0 && len(roots) < n; h -= TreeInterval {
+		var hash string
+		if err := c.call(ctx, "getblockhash", &hash, h); err != nil {
+			return nil, err
+		}
+		var hdr blockHeader
+		if err := c.call(ctx, "getblockheader", &hdr, hash, true); err != nil {
+			return nil, err
+		}
+		if len(roots) > 0 && roots[0].TreeRoot == hdr.TreeRoot {
+			continue
+		}
+		roots = append([]sync.BlockInfo{{
+			Height:    hdr.Height,
+			Timestamp: hdr.Time,
+			TreeRoot:  hdr.TreeRoot,
+		}}, roots...)
+	}
+	return roots, nil
+}
@@ -0,0 +1,159 @@
+package hsd
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// a short proof from the go-hsd-utils test vectors
+const (
+	testRoot  = "518003d4f8b90a196dcbf17b94bbaa03b85507b4b0f02a6de61cc4bb805edc77"
+	testRaw   = "0140010000879abda9fab9db0be2c395040334e3d6d06e6b654d660a4ddca796286132dad30180d646dd9d978aefbf3ca0bf0f6950e560fb000e5746e81ba47318f0a84f5c857569e6b03a2a7b19de6877c238c96dfed4914d6dd775a2d39cfbb95bf306507dfb"
+	testProof = `{"type":"TYPE_SHORT","depth":1,"nodes":[["","879abda9fab9db0be2c395040334e3d6d06e6b654d660a4ddca796286132dad3"]],` +
+		`"prefix":"1","left":"d646dd9d978aefbf3ca0bf0f6950e560fb000e5746e81ba47318f0a84f5c8575",` +
+		`"right":"69e6b03a2a7b19de6877c238c96dfed4914d6dd775a2d39cfbb95bf306507dfb"}`
+)
+
+// newNode starts a stand-in for the hsd JSON-RPC interface with a chain
+// of height blocks whose tree root changes every TreeInterval blocks.
+func newNode(t *testing.T, apiKey string, height int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, key, _ := r.BasicAuth(); key != apiKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad request: %v", err)
+			return
+		}
+
+		var result string
+		switch req.Method {
+		case "getnameresource":
+			switch string(req.Params[0]) {
+			case `"example"`:
+				result = `{"records":[{"type":"GLUE4","ns":"ns1.example.","address":"10.0.0.1"},` +
+					`{"type":"SYNTH4","address":"10.0.0.2"},` +
+					`{"type":"DS","keyTag":57355,"algorithm":8,"digestType":2,"digest":"95a57c3bab7849dbcddf7c72ada71a88146b141110318ca5be672057e865c3e2"},` +
+					`{"type":"TXT","txt":["hello"]}]}`
+			default:
+				result = "null"
+			}
+		case "getnameproof":
+			result = fmt.Sprintf(`{"hash":"00","height":%d,"root":%q,"name":"example","key":"00","proof":%s}`, height, testRoot, testProof)
+		case "getblockchaininfo":
+			result = fmt.Sprintf(`{"blocks":%d}`, height)
+		case "getblockhash":
+			result = `"` + string(req.Params[0]) + `"`
+		case "getblockheader":
+			var h int
+			fmt.Sscan(strings.Trim(string(req.Params[0]), `"`), &h)
+			result = fmt.Sprintf(`{"height":%d,"time":%d,"treeroot":"%064x"}`, h, 1700000000+h, h/TreeInterval)
+		default:
+			fmt.Fprintf(w, `{"result":null,"error":{"message":"Method not found.","code":-32601},"id":0}`)
+			return
+		}
+		fmt.Fprintf(w, `{"result":%s,"error":null,"id":0}`, result)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClient_Auth(t *testing.T) {
+	srv := newNode(t, "secret", 100)
+	ctx := context.Background()
+
+	c, _ := NewClient(srv.URL, "wrong")
+	if _, err := c.NameResource(ctx, "example"); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("got %v, want unauthorized", err)
+	}
+
+	// the api key in the url
+	c, _ = NewClient(strings.Replace(srv.URL, "http://", "http://x:secret@", 1), "")
+	if _, err := c.NameResource(ctx, "example"); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+
+	if err := c.call(ctx, "nosuchmethod", nil); err == nil || !strings.Contains(err.Error(), "Method not found") {
+		t.Errorf("got %v, want the rpc error", err)
+	}
+}
+
+func TestClient_NameResource(t *testing.T) {
+	srv := newNode(t, "", 100)
+	c, _ := NewClient(srv.URL, "")
+
+	res, err := c.NameResource(context.Background(), "nonexistent")
+	if err != nil || res != nil {
+		t.Fatalf("got %v, %v, want no resource", res, err)
+	}
+
+	res, err = c.NameResource(context.Background(), "example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rr := range res.RRs("example") {
+		got = append(got, strings.Join(strings.Fields(rr.String()), " "))
+	}
+	want := []string{
+		"example. 21600 IN NS ns1.example.",
+		"ns1.example. 21600 IN A 10.0.0.1",
+		"example. 21600 IN NS _180000g._synth.",
+		"_180000g._synth. 21600 IN A 10.0.0.2",
+		"example. 21600 IN DS 57355 8 2 95A57C3BAB7849DBCDDF7C72ADA71A88146B141110318CA5BE672057E865C3E2",
+		`example. 21600 IN TXT "hello"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestClient_NameProof(t *testing.T) {
+	srv := newNode(t, "", 100)
+	c, _ := NewClient(srv.URL, "")
+
+	p, err := c.NameProof(context.Background(), "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ext, err := p.Extension()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := hex.DecodeString("01" + testRoot + testRaw)
+	if !bytes.Equal(ext, want) {
+		t.Errorf("got %x, want %x", ext, want)
+	}
+}
+
+func TestClient_TreeRoots(t *testing.T) {
+	srv := newNode(t, "", 1000)
+	c, _ := NewClient(srv.URL, "")
+
+	roots, err := c.TreeRoots(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 5 {
+		t.Fatalf("got %d roots, want 5", len(roots))
+	}
+	for i, r := range roots {
+		// oldest first, one root per interval
+		want := fmt.Sprintf("%064x", 1000/TreeInterval-4+i)
+		if r.TreeRoot != want {
+			t.Errorf("root %d: got %s, want %s", i, r.TreeRoot, want)
+		}
+	}
+}
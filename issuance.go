@@ -0,0 +1,203 @@
+package sane
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	proofSourceCertificate = "certificate"
+	proofSourceExternal    = "external"
+)
+
+// Issuance is an entry of the issuance log describing a minted certificate
+// and the upstream verification it vouches for.
+type Issuance struct {
+	Time      time.Time `json:"time"`
+	Serial    string    `json:"serial"`
+	Hostname  string    `json:"hostname"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// Method is dane or tofu.
+	Method string `json:"method,omitempty"`
+	// Upstream is the hex encoded sha256 fingerprint of the upstream certificate.
+	Upstream string `json:"upstream,omitempty"`
+	// TLSA is the record the upstream certificate matched.
+	TLSA string `json:"tlsa,omitempty"`
+	// TreeRoot and Height identify the stored tree root the urkel proof
+	// was checked against.
+	TreeRoot string `json:"tree_root,omitempty"`
+	Height   uint32 `json:"height,omitempty"`
+	// UrkelSource and DNSSECSource tell whether the proofs came from the
+	// upstream certificate or an external service.
+	UrkelSource  string `json:"urkel_source,omitempty"`
+	DNSSECSource string `json:"dnssec_source,omitempty"`
+
+	// Prev is the hash of the previous entry, Hash is the hash of
+	// this entry with an empty Hash.
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// IssuanceLog is an append-only json lines log of minted certificates.
+// Entries are chained by hash so that edits are detected by VerifyIssuanceLog.
+type IssuanceLog struct {
+	path string
+	mu   sync.Mutex
+	last string
+}
+
+// OpenIssuanceLog opens the issuance log stored at path, creating it if needed.
+func OpenIssuanceLog(path string) (*IssuanceLog, error) {
+	l := &IssuanceLog{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, l.last, err = readIssuances(f, nil); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append adds e to the log, setting its Prev and Hash.
+func (l *IssuanceLog) Append(e *Issuance) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Prev = l.last
+	hash, err := e.hash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	l.last = hash
+	return nil
+}
+
+// VerifyIssuanceLog checks the hash chain of the log read from r
+// and returns the number of entries.
+func VerifyIssuanceLog(r io.Reader) (int, error) {
+	n, _, err := readIssuances(r, func(e *Issuance) error {
+		hash, err := e.hash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return errors.New("hash mismatch")
+		}
+		return nil
+	})
+	return n, err
+}
+
+// readIssuances reads the entries from r checking that each one refers to
+// the previous, and returns the number of entries and the last hash.
+func readIssuances(r io.Reader, fn func(e *Issuance) error) (int, string, error) {
+	var last string
+	line := 0
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line++
+		var e Issuance
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return line, last, fmt.Errorf("issuance log line %d: %v", line, err)
+		}
+		if e.Prev != last {
+			return line, last, fmt.Errorf("issuance log line %d: broken chain", line)
+		}
+		if fn != nil {
+			if err := fn(&e); err != nil {
+				return line, last, fmt.Errorf("issuance log line %d: %v", line, err)
+			}
+		}
+		last = e.Hash
+	}
+	return line, last, sc.Err()
+}
+
+// newIssuance creates the log entry for leaf minted after the upstream
+// connection was verified as described by v.
+func newIssuance(leaf *x509.Certificate, v *verification) *Issuance {
+	e := &Issuance{
+		Time:      time.Now().UTC(),
+		Serial:    leaf.SerialNumber.Text(16),
+		Hostname:  leaf.Subject.CommonName,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}
+	if v == nil {
+		return e
+	}
+
+	e.Method = "dane"
+	if v.tofu {
+		e.Method = "tofu"
+	}
+	if v.cert != nil {
+		fp := sha256.Sum256(v.cert.Raw)
+		e.Upstream = hex.EncodeToString(fp[:])
+	}
+	if v.tlsa != nil {
+		e.TLSA = v.tlsa.String()
+	}
+	if v.proof != nil {
+		e.TreeRoot = v.proof.Root.TreeRoot
+		e.Height = v.proof.Root.Height
+		e.UrkelSource, e.DNSSECSource = proofSourceCertificate, proofSourceCertificate
+		if v.proof.ExternalUrkel {
+			e.UrkelSource = proofSourceExternal
+		}
+		if v.proof.ExternalDNSSEC {
+			e.DNSSECSource = proofSourceExternal
+		}
+	}
+	return e
+}
+
+func (e *Issuance) hash() (string, error) {
+	c := *e
+	c.Hash = ""
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
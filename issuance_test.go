@@ -0,0 +1,82 @@
+package sane
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/randomlogin/sane/prove"
+	"github.com/randomlogin/sane/sync"
+)
+
+func TestIssuanceLog(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "issued.jsonl")
+	l, err := OpenIssuanceLog(p)
+	if err != nil {
+		t.Fatalf("OpenIssuanceLog(): got %v, want no error", err)
+	}
+
+	ca, priv, err := NewAuthority("TEST", "TEST", 24*time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newMITMConfig(ca, priv, time.Hour, "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.issuances = l
+
+	tlsa, _ := dns.NewRR("_443._tcp.htools. 300 IN TLSA 3 1 1 " + strings.Repeat("ab", 32))
+	v := &verification{
+		cert:  ca,
+		tlsa:  tlsa.(*dns.TLSA),
+		proof: &prove.Proof{Root: sync.BlockInfo{Height: 1000, TreeRoot: "00ff"}, ExternalDNSSEC: true},
+	}
+	if _, err := c.issue("htools", v); err != nil {
+		t.Fatalf("c.issue(htools): got %v, want no error", err)
+	}
+	// cached certificates are not logged again
+	if _, err := c.issue("htools", v); err != nil {
+		t.Fatalf("c.issue(htools): got %v, want no error", err)
+	}
+
+	// the chain continues after reopening the log
+	if c.issuances, err = OpenIssuanceLog(p); err != nil {
+		t.Fatalf("OpenIssuanceLog(): got %v, want no error", err)
+	}
+	for _, host := range []string{"a.htools", "b.htools"} {
+		if _, err := c.cert(host); err != nil {
+			t.Fatalf("c.cert(%s): got %v, want no error", host, err)
+		}
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := VerifyIssuanceLog(bytes.NewReader(b)); err != nil || n != 3 {
+		t.Fatalf("VerifyIssuanceLog(): got %d, %v, want 3 entries", n, err)
+	}
+
+	lines := strings.SplitAfter(string(b), "\n")
+	for _, field := range []string{`"height":1000`, `"tree_root":"00ff"`, `"urkel_source":"certificate"`, `"dnssec_source":"external"`, `"method":"dane"`} {
+		if !strings.Contains(lines[0], field) {
+			t.Errorf("entry %s: missing %s", lines[0], field)
+		}
+	}
+
+	tampered := []string{
+		strings.Replace(string(b), "a.htools", "c.htools", 1),
+		lines[0] + lines[2],
+		strings.Replace(string(b), `"height":1000`, `"height":1001`, 1),
+	}
+	for _, log := range tampered {
+		if _, err := VerifyIssuanceLog(strings.NewReader(log)); err == nil {
+			t.Errorf("VerifyIssuanceLog(%s): got nil, want error", log)
+		}
+	}
+}
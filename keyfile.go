@@ -0,0 +1,252 @@
+package sane
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF is the key derivation function used to encrypt private keys.
+type KDF int
+
+const (
+	KDFScrypt KDF = iota
+	KDFPBKDF2
+)
+
+// EncryptedKeyBlockType is the pem type of keys encrypted by EncryptPKCS8PrivateKey.
+const EncryptedKeyBlockType = "ENCRYPTED PRIVATE KEY"
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+const (
+	keyLen           = 32
+	saltLen          = 16
+	scryptN          = 1 << 15
+	scryptR          = 8
+	scryptP          = 1
+	pbkdf2Iterations = 600000
+
+	// upper bounds on the cost parameters read from a key file, so a
+	// crafted file can't make decryption use unbounded memory or time
+	maxScryptMemory     = 1 << 30 // 128 * N * r bytes
+	maxScryptP          = 16
+	maxPBKDF2Iterations = 10000000
+)
+
+var errBadPassword = errors.New("decryption failed: wrong passphrase or corrupted key")
+
+// RFC 5958
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// RFC 8018
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// RFC 7914
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// RFC 5084
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+func algorithm(oid asn1.ObjectIdentifier, params interface{}) (pkix.AlgorithmIdentifier, error) {
+	b, err := asn1.Marshal(params)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.RawValue{FullBytes: b}}, nil
+}
+
+// EncryptPKCS8PrivateKey encrypts the private key as PKCS#8 using PBES2 with
+// the given key derivation function and AES-256-GCM.
+func EncryptPKCS8PrivateKey(priv interface{}, password []byte, kdf KDF) (*pem.Block, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	var kdfAlg pkix.AlgorithmIdentifier
+	switch kdf {
+	case KDFScrypt:
+		key, err = scrypt.Key(password, salt, scryptN, scryptR, scryptP, keyLen)
+		if err != nil {
+			return nil, err
+		}
+		kdfAlg, err = algorithm(oidScrypt, scryptParams{salt, scryptN, scryptR, scryptP, keyLen})
+	case KDFPBKDF2:
+		key = pbkdf2.Key(password, salt, pbkdf2Iterations, keyLen, sha256.New)
+		prf := pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue}
+		kdfAlg, err = algorithm(oidPBKDF2, pbkdf2Params{salt, pbkdf2Iterations, keyLen, prf})
+	default:
+		return nil, fmt.Errorf("unsupported kdf %d", kdf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	encAlg, err := algorithm(oidAES256GCM, gcmParams{nonce, aead.Overhead()})
+	if err != nil {
+		return nil, err
+	}
+	alg, err := algorithm(oidPBES2, pbes2Params{kdfAlg, encAlg})
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := asn1.Marshal(encryptedPrivateKeyInfo{alg, aead.Seal(nil, nonce, der, nil)})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: EncryptedKeyBlockType, Bytes: b}, nil
+}
+
+// DecryptPKCS8PrivateKey decrypts a PKCS#8 key encrypted with PBES2 using
+// scrypt or PBKDF2 and AES-256-GCM.
+func DecryptPKCS8PrivateKey(der, password []byte) (interface{}, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("couldn't parse encrypted key: %v", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %v", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("couldn't parse pbes2 parameters: %v", err)
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if !params.EncryptionScheme.Algorithm.Equal(oidAES256GCM) {
+		return nil, fmt.Errorf("unsupported encryption scheme %v", params.EncryptionScheme.Algorithm)
+	}
+	var gcm gcmParams
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &gcm); err != nil {
+		return nil, fmt.Errorf("couldn't parse gcm parameters: %v", err)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(gcm.Nonce) != aead.NonceSize() || gcm.ICVLen != aead.Overhead() {
+		return nil, errors.New("unsupported gcm parameters")
+	}
+
+	plain, err := aead.Open(nil, gcm.Nonce, info.EncryptedData, nil)
+	if err != nil {
+		return nil, errBadPassword
+	}
+	return x509.ParsePKCS8PrivateKey(plain)
+}
+
+func deriveKey(alg pkix.AlgorithmIdentifier, password []byte) ([]byte, error) {
+	switch {
+	case alg.Algorithm.Equal(oidScrypt):
+		var p scryptParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &p); err != nil {
+			return nil, fmt.Errorf("couldn't parse scrypt parameters: %v", err)
+		}
+		if p.KeyLength != 0 && p.KeyLength != keyLen {
+			return nil, fmt.Errorf("unsupported key length %d", p.KeyLength)
+		}
+		if p.CostParameter <= 0 || p.BlockSize <= 0 || p.ParallelizationParameter <= 0 ||
+			p.CostParameter > maxScryptMemory/128/p.BlockSize || p.ParallelizationParameter > maxScryptP {
+			return nil, fmt.Errorf("scrypt parameters N=%d r=%d p=%d exceed the supported maximum",
+				p.CostParameter, p.BlockSize, p.ParallelizationParameter)
+		}
+		return scrypt.Key(password, p.Salt, p.CostParameter, p.BlockSize, p.ParallelizationParameter, keyLen)
+	case alg.Algorithm.Equal(oidPBKDF2):
+		var p pbkdf2Params
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &p); err != nil {
+			return nil, fmt.Errorf("couldn't parse pbkdf2 parameters: %v", err)
+		}
+		if p.KeyLength != 0 && p.KeyLength != keyLen {
+			return nil, fmt.Errorf("unsupported key length %d", p.KeyLength)
+		}
+
+		if p.IterationCount <= 0 || p.IterationCount > maxPBKDF2Iterations {
+			return nil, fmt.Errorf("pbkdf2 iteration count %d exceeds the supported maximum", p.IterationCount)
+		}
+
+		var h func() hash.Hash
+		switch {
+		case len(p.PRF.Algorithm) == 0 || p.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case p.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		default:
+			return nil, fmt.Errorf("unsupported pbkdf2 prf %v", p.PRF.Algorithm)
+		}
+		return pbkdf2.Key(password, p.Salt, p.IterationCount, keyLen, h), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key derivation function %v", alg.Algorithm)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,76 @@
+package sane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"reflect"
+	"testing"
+)
+
+func TestEncryptPKCS8PrivateKey(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kdf := range []KDF{KDFScrypt, KDFPBKDF2} {
+		block, err := EncryptPKCS8PrivateKey(priv, []byte("secret"), kdf)
+		if err != nil {
+			t.Fatalf("EncryptPKCS8PrivateKey(%d): got %v, want no error", kdf, err)
+		}
+		if block.Type != EncryptedKeyBlockType {
+			t.Errorf("block.Type: got %q, want %q", block.Type, EncryptedKeyBlockType)
+		}
+
+		got, err := DecryptPKCS8PrivateKey(block.Bytes, []byte("secret"))
+		if err != nil {
+			t.Fatalf("DecryptPKCS8PrivateKey(%d): got %v, want no error", kdf, err)
+		}
+		if !reflect.DeepEqual(got, priv) {
+			t.Errorf("DecryptPKCS8PrivateKey(%d): got a different key", kdf)
+		}
+
+		if _, err := DecryptPKCS8PrivateKey(block.Bytes, []byte("wrong")); err != errBadPassword {
+			t.Errorf("DecryptPKCS8PrivateKey(%d) with wrong password: got %v, want %v", kdf, err, errBadPassword)
+		}
+	}
+
+	if _, err := DecryptPKCS8PrivateKey([]byte("garbage"), []byte("secret")); err == nil {
+		t.Error("DecryptPKCS8PrivateKey(garbage): got nil, want error")
+	}
+}
+
+func TestDecryptPKCS8PrivateKeyLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		oid    asn1.ObjectIdentifier
+		params interface{}
+	}{
+		{"scrypt N", oidScrypt, scryptParams{[]byte("salt"), 1 << 30, 8, 1, keyLen}},
+		{"scrypt r", oidScrypt, scryptParams{[]byte("salt"), 1 << 15, 1 << 20, 1, keyLen}},
+		{"scrypt p", oidScrypt, scryptParams{[]byte("salt"), 1 << 15, 8, 1 << 20, keyLen}},
+		{"pbkdf2", oidPBKDF2, pbkdf2Params{[]byte("salt"), 1 << 30, keyLen, pkix.AlgorithmIdentifier{}}},
+	}
+
+	for _, tt := range tests {
+		kdfAlg, err := algorithm(tt.oid, tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alg, err := algorithm(oidPBES2, pbes2Params{kdfAlg, pkix.AlgorithmIdentifier{Algorithm: oidAES256GCM}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := asn1.Marshal(encryptedPrivateKeyInfo{alg, []byte("data")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := DecryptPKCS8PrivateKey(der, []byte("secret")); err == nil {
+			t.Errorf("%s: got nil, want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package sane
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNoPin = errors.New("no pin found")
+
+// Pin is a trust-on-first-use record of the upstream public key
+// seen for a handshake name without TLSA records.
+type Pin struct {
+	Host string `json:"host"`
+	// SPKI is the hex encoded sha256 hash of the pinned
+	// subject public key info.
+	SPKI      string    `json:"spki"`
+	FirstSeen time.Time `json:"first_seen"`
+	// Pending holds a mismatching key seen after the pin was
+	// recorded. It replaces SPKI once approved.
+	Pending   string    `json:"pending,omitempty"`
+	PendingAt time.Time `json:"pending_at"`
+}
+
+// PinStore keeps TOFU pins in a json file. The file is re-read on every
+// operation so that changes made with the pin commands are picked up by
+// a running proxy.
+type PinStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewPinStore creates a pin store backed by the given file.
+func NewPinStore(path string) (*PinStore, error) {
+	s := &PinStore{path: path}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PinStore) load() (map[string]*Pin, error) {
+	pins := make(map[string]*Pin)
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Pin
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("couldn't parse pins file: %v", err)
+	}
+	for _, p := range list {
+		pins[p.Host] = p
+	}
+	return pins, nil
+}
+
+func (s *PinStore) save(pins map[string]*Pin) error {
+	list := make([]*Pin, 0, len(pins))
+	for _, p := range pins {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, b, 0600)
+}
+
+// Check verifies the subject public key info against the pin for host.
+// The key is pinned if the host was never seen before. A mismatching key
+// is recorded as pending and an error is returned.
+func (s *PinStore) Check(host string, spki []byte) error {
+	sum := sha256.Sum256(spki)
+	h := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pins, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	p, ok := pins[host]
+	if !ok {
+		pins[host] = &Pin{Host: host, SPKI: h, FirstSeen: time.Now()}
+		return s.save(pins)
+	}
+	if p.SPKI == h {
+		return nil
+	}
+
+	if p.Pending != h {
+		p.Pending = h
+		p.PendingAt = time.Now()
+		if err := s.save(pins); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("public key for %s does not match the pinned one (pending approval: %s)", host, h)
+}
+
+// List returns all pins sorted by host.
+func (s *PinStore) List() ([]Pin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pins, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Pin, 0, len(pins))
+	for _, p := range pins {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list, nil
+}
+
+// Approve replaces the pin for host with its pending key.
+func (s *PinStore) Approve(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pins, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	p, ok := pins[host]
+	if !ok {
+		return errNoPin
+	}
+	if p.Pending == "" {
+		return fmt.Errorf("no pending key for %s", host)
+	}
+
+	p.SPKI = p.Pending
+	p.FirstSeen = p.PendingAt
+	p.Pending = ""
+	p.PendingAt = time.Time{}
+	return s.save(pins)
+}
+
+// Revoke removes the pin for host, the next visit pins a new key.
+func (s *PinStore) Revoke(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pins, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := pins[host]; !ok {
+		return errNoPin
+	}
+	delete(pins, host)
+	return s.save(pins)
+}
@@ -0,0 +1,82 @@
+package sane
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPinStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pins.json")
+	pins, err := NewPinStore(file)
+	if err != nil {
+		t.Fatalf("NewPinStore(): got %v, want no error", err)
+	}
+
+	keyA, keyB := []byte("key a"), []byte("key b")
+
+	if err := pins.Check("example", keyA); err != nil {
+		t.Fatalf("first use: got %v, want no error", err)
+	}
+	if err := pins.Check("example", keyA); err != nil {
+		t.Fatalf("pinned key: got %v, want no error", err)
+	}
+	if err := pins.Check("example", keyB); err == nil {
+		t.Fatal("different key: got nil, want error")
+	}
+
+	// another store on the same file sees the pending key
+	other, _ := NewPinStore(file)
+	list, err := other.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Pending == "" {
+		t.Fatalf("got %+v, want one pin with a pending key", list)
+	}
+
+	if err := other.Approve("example"); err != nil {
+		t.Fatalf("Approve(): got %v, want no error", err)
+	}
+	if err := pins.Check("example", keyB); err != nil {
+		t.Fatalf("approved key: got %v, want no error", err)
+	}
+	if err := pins.Check("example", keyA); err == nil {
+		t.Fatal("old key: got nil, want error")
+	}
+
+	if err := pins.Revoke("example"); err != nil {
+		t.Fatalf("Revoke(): got %v, want no error", err)
+	}
+	if err := pins.Revoke("example"); err != errNoPin {
+		t.Fatalf("Revoke(): got %v, want %v", err, errNoPin)
+	}
+	if err := pins.Check("example", keyA); err != nil {
+		t.Fatalf("first use after revoke: got %v, want no error", err)
+	}
+}
+
+func TestTunnelerTOFUEnabled(t *testing.T) {
+	pins, _ := NewPinStore(filepath.Join(t.TempDir(), "pins.json"))
+	h := &tunneler{pins: pins}
+
+	var tests = []struct {
+		host string
+		want bool
+	}{
+		{"example.com", false},
+		{"127.0.0.1", false},
+		{"htools", true},
+		{"test.lazydane", true},
+	}
+
+	for _, test := range tests {
+		if got := h.tofuEnabled(test.host); got != test.want {
+			t.Errorf("tofuEnabled(%q): got %v, want %v", test.host, got, test.want)
+		}
+	}
+
+	h.pins = nil
+	if h.tofuEnabled("htools") {
+		t.Error("tofuEnabled with no pin store: got true, want false")
+	}
+}
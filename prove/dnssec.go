@@ -54,14 +54,25 @@ func verifyDNSSECChain(chainWireData []byte, domain string, dns_tlsa *dns.TLSA)
 		return fmt.Errorf("TLSA records from extension do not correspond to the server ones")
 	}
 
+	// the TLSA record may be the target of a CNAME chain
+	// starting at the TLSA name of the domain
+	owners := []string{dns_tlsa.Hdr.Name}
+	for i := 0; i < len(owners) && i <= len(records); i++ {
+		for _, record := range records {
+			if c, ok := record.(*dns.CNAME); ok && strings.EqualFold(c.Target, owners[i]) {
+				owners = append(owners, c.Hdr.Name)
+			}
+		}
+	}
+
 	domainCovered := false
-	for _, tlsa := range tlsas {
-		tlsaLabels := dns.SplitDomainName(tlsa.Hdr.Name)
-		if len(tlsaLabels) < 3 {
-			return fmt.Errorf("TLSA records had less than 3 labels")
+	for _, owner := range owners {
+		labels := dns.SplitDomainName(owner)
+		if len(labels) < 3 {
+			continue
 		}
-		child := dns.Fqdn(strings.Join(tlsaLabels[2:], "."))
-		if child == dns.Fqdn(domain) {
+		child := dns.Fqdn(strings.Join(labels[2:], "."))
+		if strings.EqualFold(child, dns.Fqdn(domain)) {
 			domainCovered = true
 			break
 		}
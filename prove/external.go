@@ -21,6 +21,16 @@ type DNSSECJson struct {
 
 var timeout = 10 * time.Second
 
+// urkelSource fetches urkel proofs missing from certificates when set.
+var urkelSource func(tld string) ([]byte, error)
+
+// SetUrkelSource makes urkel proofs missing from certificates fetched with
+// fn instead of the external services. fn returns the proof serialized like
+// the certificate extension, SetUrkelSource must be called before verifying.
+func SetUrkelSource(fn func(tld string) ([]byte, error)) {
+	urkelSource = fn
+}
+
 func fetchDNSSEC(domain string, externalServices []string) ([]byte, error) {
 	for _, link := range externalServices {
 		//fetch full domain
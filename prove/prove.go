@@ -22,30 +22,50 @@ func (t *tlsError) Error() string {
 	return t.err
 }
 
+// Proof describes the proofs a certificate was verified with.
+type Proof struct {
+	// Root is the stored tree root the urkel proof was checked against.
+	Root sync.BlockInfo
+	// ExternalUrkel and ExternalDNSSEC are set if the proof was fetched
+	// from an external service instead of the certificate extension.
+	ExternalUrkel  bool
+	ExternalDNSSEC bool
+}
+
 // extracts proof data from the certificate then verifies if the proof is correct
 func VerifyCertificateExtensions(roots []sync.BlockInfo, cert x509.Certificate, tlsa *dns.TLSA, externalServices []string) error {
-	if len(cert.DNSNames) == 0 {
-		return fmt.Errorf("certificate has empty dns names")
-	}
 	labels := dns.SplitDomainName(tlsa.Header().Name)
 	if len(labels) < 3 {
 		return fmt.Errorf("tlsa record has less than 3 labels")
 	}
-	tlsaDomain := strings.Join(labels[2:], ".")
+	_, err := VerifyCertificateProof(roots, cert, strings.Join(labels[2:], "."), tlsa, externalServices)
+	return err
+}
+
+// VerifyCertificateProof is like VerifyCertificateExtensions for the TLSA base domain
+// tlsaDomain (RFC 7671 section 7) and also returns the proofs used.
+func VerifyCertificateProof(roots []sync.BlockInfo, cert x509.Certificate, tlsaDomain string, tlsa *dns.TLSA, externalServices []string) (*Proof, error) {
+	if len(cert.DNSNames) == 0 {
+		return nil, fmt.Errorf("certificate has empty dns names")
+	}
+	tlsaDomain = strings.TrimSuffix(tlsaDomain, ".")
+	if len(dns.SplitDomainName(tlsaDomain)) == 0 {
+		return nil, fmt.Errorf("tlsa base domain is empty")
+	}
 
 	for _, domain := range cert.DNSNames {
-		err := verifyDomain(tlsaDomain, cert, roots, tlsa, externalServices)
+		proof, err := verifyDomain(tlsaDomain, cert, roots, tlsa, externalServices)
 		if err == nil {
 			log.Printf("successfully verified certificate extensions for the domain %s", domain)
-			return nil
+			return proof, nil
 		}
 		log.Printf("during verification of the domain %s got error: %s", domain, err)
 	}
-	return fmt.Errorf("failed to verify certificate extensions")
+	return nil, fmt.Errorf("failed to verify certificate extensions")
 }
 
 // verifyDomain is called to check every domain listed in the certificate
-func verifyDomain(domain string, cert x509.Certificate, roots []sync.BlockInfo, tlsa *dns.TLSA, externalServices []string) error {
+func verifyDomain(domain string, cert x509.Certificate, roots []sync.BlockInfo, tlsa *dns.TLSA, externalServices []string) (*Proof, error) {
 	var foundUrkel, foundDnssec bool
 	var urkelExtension, dnssecExtension []byte
 	var UrkelVerificationError, DNSSECVerificationError error = errors.New("urkel tree proof extension not found"), errors.New("DNSSEC chain extension not found")
@@ -66,38 +86,45 @@ func verifyDomain(domain string, cert x509.Certificate, roots []sync.BlockInfo,
 	}
 
 	if !foundUrkel {
-		if len(externalServices) == 0 {
-			return fmt.Errorf("certificate does not have an urkel proof extension and external service is disabled")
-		}
-		urkelExtension, err = fetchUrkel(domain, externalServices)
-		if err != nil {
-			return err
+		switch {
+		case urkelSource != nil:
+			urkelExtension, err = urkelSource(tld)
+			if err != nil {
+				return nil, fmt.Errorf("could not fetch the urkel proof of %s: %v", tld, err)
+			}
+		case len(externalServices) == 0:
+			return nil, fmt.Errorf("certificate does not have an urkel proof extension and external service is disabled")
+		default:
+			urkelExtension, err = fetchUrkel(domain, externalServices)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	if !foundDnssec {
 		if len(externalServices) == 0 {
-			return fmt.Errorf("certificate does not have dnssec chain extension and external service is disabled")
+			return nil, fmt.Errorf("certificate does not have dnssec chain extension and external service is disabled")
 		}
 		dnssecExtension, err = fetchDNSSEC(domain, externalServices)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	UrkelVerificationError = verifyUrkelExt(urkelExtension, tld, roots)
+	root, UrkelVerificationError := verifyUrkelExt(urkelExtension, tld, roots)
 	if UrkelVerificationError != nil {
-		return UrkelVerificationError
+		return nil, UrkelVerificationError
 	}
 
 	DNSSECVerificationError = verifyDNSSECChain(dnssecExtension, domain, tlsa)
 	if DNSSECVerificationError != nil {
-		return DNSSECVerificationError
+		return nil, DNSSECVerificationError
 	}
 
 	if (UrkelVerificationError == nil) && (DNSSECVerificationError == nil) {
-		return nil
+		return &Proof{Root: root, ExternalUrkel: !foundUrkel, ExternalDNSSEC: !foundDnssec}, nil
 	} else {
-		return fmt.Errorf("could not verify SANE for the domain %s: %s, %s", domain, UrkelVerificationError, DNSSECVerificationError)
+		return nil, fmt.Errorf("could not verify SANE for the domain %s: %s, %s", domain, UrkelVerificationError, DNSSECVerificationError)
 	}
 }
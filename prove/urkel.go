@@ -33,18 +33,18 @@ func checkUrkelProof(certProof, certRoot, key []byte) (*int, error) {
 	return &x, nil
 }
 
-func verifyUrkelExt(extensionValue []byte, domain string, roots []sync.BlockInfo) error {
+func verifyUrkelExt(extensionValue []byte, domain string, roots []sync.BlockInfo) (sync.BlockInfo, error) {
 	h := sha3.New256()
 	h.Write([]byte(domain))
 	key := h.Sum(nil)
 
 	if len(extensionValue) < 0 {
-		return fmt.Errorf("urkel data is corrupted")
+		return sync.BlockInfo{}, fmt.Errorf("urkel data is corrupted")
 	}
 
 	var numberOfProofs, i uint8 = extensionValue[0], 0
 	if numberOfProofs == 0 {
-		return fmt.Errorf("urkel extension is empty")
+		return sync.BlockInfo{}, fmt.Errorf("urkel extension is empty")
 	}
 	extensionValue = extensionValue[1:]
 	for ; i < numberOfProofs; i++ {
@@ -56,17 +56,17 @@ func verifyUrkelExt(extensionValue []byte, domain string, roots []sync.BlockInfo
 		if err != nil {
 			//found invalid proof
 			log.Printf("urkel verification failed: %s", err)
-			return err
+			return sync.BlockInfo{}, err
 		}
 		for _, block := range roots {
 			// found tree root among stored ones
 			if hexstr == block.TreeRoot {
 				log.Printf("found tree root %s from the certificate in the stored roots", hexstr)
-				return nil
+				return block, nil
 			}
 		}
 		extensionValue = extensionValue[32+*length:]
 		log.Printf("could not find tree root %s from the certificate in the stored roots", hexstr)
 	}
-	return fmt.Errorf("could not find tree root in the stored ones")
+	return sync.BlockInfo{}, fmt.Errorf("could not find tree root in the stored ones")
 }
@@ -1,61 +1,274 @@
 package resolver
 
-// basic caching for ad resolver
+// lru cache for the stub resolver
 import (
-	"github.com/miekg/dns"
+	"container/list"
+	"context"
 	"sync"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 type entry struct {
-	msg    []dns.RR
-	secure bool
-	ttl    time.Time
+	msg []dns.RR
+	// ns is the SOA of negative answers
+	ns       []dns.RR
+	secure   bool
+	nxdomain bool
+	ttl      time.Time
+	// lifetime is the ttl the entry was stored with
+	lifetime time.Duration
+	// hits since the entry was stored, popular entries are prefetched
+	hits        int
+	prefetching bool
+}
+
+// CacheStats are counters of the stub resolver cache.
+type CacheStats struct {
+	Entries    int
+	Hits       uint64
+	Misses     uint64
+	Stale      uint64
+	Prefetches uint64
+	Evictions  uint64
+}
+
+type cacheItem struct {
+	key string
+	e   *entry
 }
 
 type cache struct {
-	m    map[string]*entry
+	ll   *list.List
+	m    map[string]*list.Element
 	maxN int
 
-	sync.RWMutex
+	stats CacheStats
+	sync.Mutex
 }
 
 func newCache(maxN int) (m *cache) {
-	return &cache{m: make(map[string]*entry), maxN: maxN}
+	return &cache{ll: list.New(), m: make(map[string]*list.Element), maxN: maxN}
 }
 
 func (c *cache) set(key string, item *entry) {
 	c.Lock()
 	defer c.Unlock()
 
-	if c.maxN == len(c.m) {
-		for k := range c.m {
-			delete(c.m, k)
-			break
+	if el, ok := c.m[key]; ok {
+		el.Value.(*cacheItem).e = item
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	if c.maxN > 0 && c.ll.Len() >= c.maxN {
+		if last := c.ll.Back(); last != nil {
+			c.ll.Remove(last)
+			delete(c.m, last.Value.(*cacheItem).key)
+			c.stats.Evictions++
 		}
 	}
 
-	c.m[key] = item
+	c.m[key] = c.ll.PushFront(&cacheItem{key, item})
 }
 
 func (c *cache) get(key string) (*entry, bool) {
-	c.RLock()
-	defer c.RUnlock()
+	c.Lock()
+	defer c.Unlock()
 
-	i, ok := c.m[key]
-	return i, ok
+	el, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheItem).e, true
 }
 
 func (c *cache) remove(key string) {
 	c.Lock()
 	defer c.Unlock()
 
-	delete(c.m, key)
+	if el, ok := c.m[key]; ok {
+		c.ll.Remove(el)
+		delete(c.m, key)
+	}
 }
 
 func (c *cache) len() int {
-	c.RLock()
-	defer c.RUnlock()
+	c.Lock()
+	defer c.Unlock()
+
+	return c.ll.Len()
+}
+
+// count updates the stats with fn.
+func (c *cache) count(fn func(s *CacheStats)) {
+	c.Lock()
+	defer c.Unlock()
+
+	fn(&c.stats)
+}
+
+func (c *cache) statistics() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	s := c.stats
+	s.Entries = c.ll.Len()
+	return s
+}
+
+const (
+	// entries hit prefetchHits times are refreshed
+	// when less than a tenth of their ttl is left
+	prefetchHits = 3
+	// RFC 8767 section 4
+	staleAnswerTTL = 30
+)
+
+// cacheKey keeps secure and insecure answers apart so that an
+// insecure answer never replaces a secure one.
+func cacheKey(name string, qtype uint16, secure bool) string {
+	key := dns.CanonicalName(name) + "/" + dns.TypeToString[qtype]
+	if secure {
+		return key + "/secure"
+	}
+	return key
+}
+
+// cached returns the cached answer for name preferring secure ones, and
+// whether it is fresh. Expired answers are returned if they may be served stale.
+func (s *Stub) cached(name string, qtype uint16) (*entry, bool) {
+	var stale *entry
+	for _, secure := range []bool{true, false} {
+		key := cacheKey(name, qtype, secure)
+		e, ok := s.cache.get(key)
+		if !ok {
+			continue
+		}
+		if time.Now().Before(e.ttl) {
+			return e, true
+		}
+		if time.Since(e.ttl) > s.StaleTTL {
+			s.cache.remove(key)
+			continue
+		}
+		if stale == nil {
+			stale = e
+		}
+	}
+	return stale, false
+}
+
+// store caches e for the ttl of r.
+func (s *Stub) store(name string, qtype uint16, e *entry, r *dns.Msg) {
+	ttl, ok := s.cacheTTL(r)
+	if !ok {
+		return
+	}
+	e.lifetime = ttl
+	e.ttl = time.Now().Add(ttl)
+
+	s.cache.set(cacheKey(name, qtype, e.secure), e)
+	if e.secure {
+		s.cache.remove(cacheKey(name, qtype, false))
+	}
+}
+
+// cacheTTL returns how long r may be cached. Negative answers are cached
+// for the SOA minimum and not at all without a SOA record (RFC 2308).
+func (s *Stub) cacheTTL(r *dns.Msg) (time.Duration, bool) {
+	if r.Rcode == dns.RcodeNameError || len(r.Answer) == 0 {
+		for _, rr := range r.Ns {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				continue
+			}
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			d := time.Duration(ttl) * time.Second
+			if d > s.NegativeTTL {
+				d = s.NegativeTTL
+			}
+			return d, d > 0
+		}
+		return 0, false
+	}
+
+	ttl := getMinTTL(r, s.MaxTTL)
+	if ttl < s.MinTTL {
+		ttl = s.MinTTL
+	}
+	return ttl, true
+}
+
+// negativeSOA returns the SOA of a negative answer r with the
+// smaller of its ttl and minimum as ttl (RFC 2308 section 3).
+func negativeSOA(r *dns.Msg) []dns.RR {
+	if r.Rcode != dns.RcodeNameError && len(r.Answer) > 0 {
+		return nil
+	}
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa = dns.Copy(soa).(*dns.SOA)
+			soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+			return []dns.RR{soa}
+		}
+	}
+	return nil
+}
+
+// prefetch refreshes popular entries before they expire.
+func (s *Stub) prefetch(name string, qtype uint16, e *entry) {
+	s.cache.Lock()
+	e.hits++
+	refresh := e.hits >= prefetchHits && !e.prefetching && time.Until(e.ttl) < e.lifetime/10
+	if refresh {
+		e.prefetching = true
+		s.cache.stats.Prefetches++
+	}
+	s.cache.Unlock()
+
+	if refresh {
+		go s.flight.do(context.Background(), flightKey(name, qtype), func(ctx context.Context) *DNSResult {
+			return s.resolve(ctx, name, qtype)
+		})
+	}
+}
+
+// remaining returns the seconds left until e expires.
+func (e *entry) remaining() uint32 {
+	d := time.Until(e.ttl)
+	if d <= 0 {
+		return 0
+	}
+	return uint32((d + time.Second - 1) / time.Second)
+}
+
+// result returns the answer of e with the ttl left, cached
+// records are copied as they are shared between lookups.
+func (e *entry) result() *DNSResult {
+	ttl := e.remaining()
+	return &DNSResult{Records: withTTL(e.msg, ttl), Secure: e.secure, NXDomain: e.nxdomain, Authority: withTTL(e.ns, ttl)}
+}
+
+// withTTL returns copies of rrs with their ttl lowered to ttl.
+func withTTL(rrs []dns.RR, ttl uint32) []dns.RR {
+	if rrs == nil {
+		return nil
+	}
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = dns.Copy(rr)
+		out[i].Header().Ttl = min(rr.Header().Ttl, ttl)
+	}
+	return out
+}
 
-	return len(c.m)
+// CacheStats returns the cache counters.
+func (s *Stub) CacheStats() CacheStats {
+	return s.cache.statistics()
 }
@@ -1,8 +1,14 @@
 package resolver
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 func TestCache(t *testing.T) {
@@ -21,3 +27,122 @@ func TestCache(t *testing.T) {
 		t.Fatalf("want cache len = %d, got %d", maxCache, c.len())
 	}
 }
+
+func TestCache_LRU(t *testing.T) {
+	c := newCache(3)
+	c.set("a", &entry{})
+	c.set("b", &entry{})
+	c.set("c", &entry{})
+	c.get("a")
+	c.set("d", &entry{})
+
+	if _, ok := c.get("b"); ok {
+		t.Error("want least recently used key `b` evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("want key `%s`", key)
+		}
+	}
+	if st := c.statistics(); st.Evictions != 1 || st.Entries != 3 {
+		t.Errorf("stats: got %+v, want 1 eviction and 3 entries", st)
+	}
+}
+
+func TestStub_Cache(t *testing.T) {
+	soa := testRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 300")
+	responses := map[string]*dns.Msg{
+		"nx.example.com.":     {MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: []dns.RR{soa}},
+		"nosoa.example.com.":  {MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}},
+		"secure.example.com.": {MsgHdr: testHdrAD, Answer: testRRs("secure.example.com. 60 IN A 10.0.0.1")},
+		"short.example.com.":  {MsgHdr: testHdr, Answer: testRRs("short.example.com. 1 IN A 10.0.0.2")},
+	}
+
+	rs, _ := NewStub("0.0.0.0")
+	var queries int32
+	var fail, insecure atomic.Bool
+	rs.exchangeFunc = func(ctx context.Context, req *dns.Msg, c *client) (*dns.Msg, time.Duration, error) {
+		atomic.AddInt32(&queries, 1)
+		if fail.Load() {
+			return nil, 0, errors.New("timeout")
+		}
+		r := responses[req.Question[0].Name].Copy()
+		if insecure.Load() {
+			r.AuthenticatedData = false
+			r.Answer = testRRs(req.Question[0].Name + " 60 IN A 10.6.6.6")
+		}
+		return r, 0, nil
+	}
+	ctx := context.Background()
+
+	// negative answers are cached for the SOA minimum
+	rs.lookup(ctx, "nx.example.com", dns.TypeA)
+	rs.lookup(ctx, "nosoa.example.com", dns.TypeA)
+	if e, ok := rs.cached("nx.example.com", dns.TypeA); !ok || e.lifetime != 300*time.Second {
+		t.Errorf("nx.example.com: got %+v, want cached for 300s", e)
+	}
+	if _, ok := rs.cached("nosoa.example.com", dns.TypeA); ok {
+		t.Error("nosoa.example.com: want negative answer without SOA not cached")
+	}
+	if res := rs.lookup(ctx, "nx.example.com", dns.TypeA); len(res.Authority) != 1 || res.Authority[0].Header().Ttl != 300 {
+		t.Errorf("nx.example.com: got authority %v, want the SOA with ttl 300", res.Authority)
+	}
+
+	// ttl caps
+	rs.MinTTL = 5 * time.Second
+	rs.lookup(ctx, "short.example.com", dns.TypeA)
+	if e, _ := rs.cached("short.example.com", dns.TypeA); e == nil || e.lifetime != 5*time.Second {
+		t.Errorf("short.example.com: got %+v, want lifetime 5s", e)
+	}
+
+	// cached answers are served with the ttl left
+	rs.lookup(ctx, "secure.example.com", dns.TypeA)
+	e := rs.cache.m[cacheKey("secure.example.com", dns.TypeA, true)].Value.(*cacheItem).e
+	e.ttl = time.Now().Add(10 * time.Second)
+	if res := rs.lookup(ctx, "secure.example.com", dns.TypeA); res.Records[0].Header().Ttl != 10 {
+		t.Errorf("secure.example.com: got ttl %d, want 10", res.Records[0].Header().Ttl)
+	}
+	if e.msg[0].Header().Ttl != 60 {
+		t.Errorf("secure.example.com: got cached ttl %d, want 60", e.msg[0].Header().Ttl)
+	}
+
+	// an insecure answer doesn't replace a secure one
+	insecure.Store(true)
+	e.ttl = time.Now().Add(-time.Second)
+	rs.resolve(ctx, "secure.example.com", dns.TypeA)
+	insecure.Store(false)
+	if _, ok := rs.cache.get(cacheKey("secure.example.com", dns.TypeA, true)); !ok {
+		t.Error("secure.example.com: want secure entry kept")
+	}
+	rs.cache.remove(cacheKey("secure.example.com", dns.TypeA, false))
+
+	// expired answers are served when upstreams fail
+	fail.Store(true)
+	res := rs.lookup(ctx, "secure.example.com", dns.TypeA)
+	if res.Err != nil || !res.Secure || res.Records[0].Header().Ttl != staleAnswerTTL {
+		t.Errorf("stale secure.example.com: got %+v, want secure stale answer", res)
+	}
+	rs.StaleTTL = 0
+	if res := rs.lookup(ctx, "secure.example.com", dns.TypeA); res.Err == nil {
+		t.Error("secure.example.com without serve-stale: got nil, want error")
+	}
+	fail.Store(false)
+
+	// popular entries are prefetched before they expire
+	rs.lookup(ctx, "secure.example.com", dns.TypeA)
+	e, _ = rs.cached("secure.example.com", dns.TypeA)
+	e.ttl = time.Now().Add(e.lifetime / 20)
+	before := atomic.LoadInt32(&queries)
+	for i := 0; i < prefetchHits; i++ {
+		rs.lookup(ctx, "secure.example.com", dns.TypeA)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&queries) - before; got != 1 {
+		t.Errorf("prefetch: got %d queries, want 1", got)
+	}
+
+	st := rs.CacheStats()
+	if st.Hits == 0 || st.Misses == 0 || st.Stale != 1 || st.Prefetches != 1 {
+		t.Errorf("stats: got %+v", st)
+	}
+}
@@ -0,0 +1,272 @@
+package resolver
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// denial is what a set of NSEC or NSEC3 records proves about a name.
+type denial int
+
+const (
+	// nothing is proven
+	denialNone denial = iota
+	// the name exists without the queried type
+	denialNoData
+	// the name doesn't exist
+	denialName
+	// the name is covered by an NSEC3 opt-out span, it may be
+	// an insecure delegation
+	denialOptOut
+)
+
+var supportedAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+var supportedDigests = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+// canonicalCompare orders names as in RFC 4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := bytes.Compare(labelBytes(la[i]), labelBytes(lb[j])); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(la), len(lb))
+}
+
+// labelBytes returns the lowercased wire form of a presentation format label.
+func labelBytes(label string) []byte {
+	b := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c == '\\' && i+1 < len(label) {
+			if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+				c = (label[i+1]-'0')*100 + (label[i+2]-'0')*10 + (label[i+3] - '0')
+				i += 3
+			} else {
+				c = label[i+1]
+				i++
+			}
+		}
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func equalName(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
+
+// suffix returns the last n labels of name.
+func suffix(name string, n int) string {
+	idx := dns.Split(name)
+	if n <= 0 {
+		return "."
+	}
+	if n >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+// nsecCovers tells whether nsec proves name doesn't exist.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	// names below a delegation aren't covered by the parent
+	if hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeSOA) &&
+		dns.IsSubDomain(owner, name) {
+		return false
+	}
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// the last NSEC of a zone wraps around to the apex
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+func hasType(bitmap []uint16, qtype uint16) bool {
+	return slices.Contains(bitmap, qtype)
+}
+
+func noData(bitmap []uint16, qtype uint16) bool {
+	return !hasType(bitmap, qtype) && !hasType(bitmap, dns.TypeCNAME)
+}
+
+// bitmap returns the types an NSEC or NSEC3 record says name has.
+func bitmap(ns []dns.RR, name string) ([]uint16, bool) {
+	for _, rr := range ns {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			if equalName(t.Hdr.Name, name) {
+				return t.TypeBitMap, true
+			}
+		case *dns.NSEC3:
+			if t.Match(name) {
+				return t.TypeBitMap, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// deny checks the NSEC and NSEC3 records in ns for a proof that name doesn't
+// exist (nxdomain) or has no qtype records.
+func deny(ns []dns.RR, name string, qtype uint16, nxdomain bool) denial {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range ns {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, t)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, t)
+		}
+	}
+
+	if len(nsecs) > 0 {
+		return denyNSEC(nsecs, name, qtype, nxdomain)
+	}
+	if len(nsec3s) > 0 {
+		return denyNSEC3(nsec3s, name, qtype, nxdomain)
+	}
+	return denialNone
+}
+
+func denyNSEC(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) denial {
+	if !nxdomain {
+		for _, n := range nsecs {
+			if equalName(n.Hdr.Name, name) {
+				if noData(n.TypeBitMap, qtype) {
+					return denialNoData
+				}
+				return denialNone
+			}
+		}
+	}
+
+	// the name is covered, the closest encloser is the longest
+	// common ancestor with the covering record
+	var ce string
+	for _, n := range nsecs {
+		if nsecCovers(n, name) {
+			l := max(dns.CompareDomainName(name, n.Hdr.Name), dns.CompareDomainName(name, n.NextDomain))
+			ce = suffix(name, l)
+			break
+		}
+	}
+	if ce == "" {
+		return denialNone
+	}
+
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	for _, n := range nsecs {
+		if equalName(n.Hdr.Name, wildcard) {
+			// the wildcard exists, only a wildcard no data answer is possible
+			if !nxdomain && noData(n.TypeBitMap, qtype) {
+				return denialNoData
+			}
+			return denialNone
+		}
+	}
+	if !nxdomain {
+		return denialNone
+	}
+	for _, n := range nsecs {
+		if nsecCovers(n, wildcard) {
+			return denialName
+		}
+	}
+	return denialNone
+}
+
+func denyNSEC3(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) denial {
+	if !nxdomain {
+		for _, n := range nsec3s {
+			if n.Match(name) {
+				if noData(n.TypeBitMap, qtype) {
+					return denialNoData
+				}
+				return denialNone
+			}
+		}
+	}
+
+	ce, nc, ok := closestEncloser(nsec3s, name)
+	if !ok {
+		return denialNone
+	}
+
+	var covering *dns.NSEC3
+	for _, n := range nsec3s {
+		if n.Cover(nc) {
+			covering = n
+			break
+		}
+	}
+	if covering == nil {
+		return denialNone
+	}
+
+	// RFC 5155 section 8.6, no DS for a name in an opt-out span
+	if !nxdomain && qtype == dns.TypeDS && covering.Flags&0x01 == 1 {
+		return denialOptOut
+	}
+
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	for _, n := range nsec3s {
+		if n.Match(wildcard) {
+			if !nxdomain && noData(n.TypeBitMap, qtype) {
+				return denialNoData
+			}
+			return denialNone
+		}
+	}
+	if !nxdomain {
+		return denialNone
+	}
+	for _, n := range nsec3s {
+		if n.Cover(wildcard) {
+			return denialName
+		}
+	}
+	return denialNone
+}
+
+// closestEncloser returns the closest existing ancestor of name
+// matched by an NSEC3 record and the next closer name below it.
+func closestEncloser(nsec3s []*dns.NSEC3, name string) (ce, nc string, ok bool) {
+	labels := dns.CountLabel(name)
+	for l := labels - 1; l >= 0; l-- {
+		candidate := suffix(name, l)
+		for _, n := range nsec3s {
+			if n.Match(candidate) {
+				return candidate, suffix(name, l+1), true
+			}
+		}
+	}
+	return "", "", false
+}
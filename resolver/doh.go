@@ -0,0 +1,157 @@
+package resolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohMediaType = "application/dns-message"
+	// dohPinParam in the url fragment pins the sha256 hash of the
+	// server public key, as in https://host/dns-query#pin-sha256=<base64>
+	dohPinParam = "pin-sha256"
+	dohMaxSize  = 65535
+)
+
+// newDOHClient creates an http client for the DoH server at server, reusing
+// connections and verifying the pinned server keys if any.
+func newDOHClient(server string) (*http.Client, error) {
+	pins, err := parseDOHPins(server)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(pins) > 0 {
+		tlsConfig.VerifyConnection = verifySPKI(pins)
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+
+	return &http.Client{Transport: transport, Timeout: lookupTimeout}, nil
+}
+
+func parseDOHPins(server string) ([][]byte, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	// the fragment is not query escaped, base64 pins may contain +
+	var pins [][]byte
+	for _, param := range strings.Split(u.Fragment, "&") {
+		k, p, _ := strings.Cut(param, "=")
+		if k != dohPinParam {
+			continue
+		}
+		pin, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("bad %s `%s`", dohPinParam, p)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// verifySPKI requires the server certificate to match one of the pins,
+// in addition to the usual certificate verification.
+func verifySPKI(pins [][]byte) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("doh: no server certificate")
+		}
+		h := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(h[:], pin) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("doh: server key %s is not pinned", base64.StdEncoding.EncodeToString(h[:]))
+	}
+}
+
+// dohURL returns the query url of the DoH server, /dns-query if no path is configured.
+func dohURL(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Path == "" || u.Path == "/" {
+		return strings.TrimSuffix(addr, "/") + "/dns-query"
+	}
+	return addr
+}
+
+// exchangeDOH sends m with the RFC 8484 GET method.
+func exchangeDOH(ctx context.Context, m *dns.Msg, c *client) (r *dns.Msg, rtt time.Duration, err error) {
+	// a zero id makes responses cacheable by http caches
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	u := dohURL(c.addr)
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	u += sep + "dns=" + base64.RawURLEncoding.EncodeToString(buf)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("accept", dohMediaType)
+
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("error fetching response %s", resp.Status)
+	}
+	if ct := resp.Header.Get("content-type"); ct != dohMediaType {
+		return nil, 0, fmt.Errorf("unexpected content type %s", ct)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt = time.Since(start)
+
+	ans := new(dns.Msg)
+	if err := ans.Unpack(b); err != nil {
+		return nil, rtt, err
+	}
+	ans.Id = m.Id
+
+	return ans, rtt, nil
+}
@@ -0,0 +1,84 @@
+package resolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExchangeDOH(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/resolve" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		b, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil || q.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+
+		ans := testData[q.Question[0].Qtype][q.Question[0].Name].Copy()
+		ans.SetReply(q)
+		out, _ := ans.Pack()
+		w.Header().Set("content-type", dohMediaType)
+		w.Write(out)
+	}))
+	defer srv.Close()
+
+	spki := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(spki[:])
+	other := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	tests := []struct {
+		server string
+		ok     bool
+	}{
+		{srv.URL + "/resolve{?dns}", true},
+		{srv.URL + "/resolve#pin-sha256=" + pin, true},
+		{srv.URL + "/resolve#pin-sha256=" + other + "&pin-sha256=" + pin, true},
+		{srv.URL + "/resolve#pin-sha256=" + other, false},
+		{srv.URL, false},
+	}
+	for _, test := range tests {
+		c, err := newClient(test.server)
+		if err != nil {
+			t.Fatalf("newClient(%s): got %v, want no error", test.server, err)
+		}
+		c.http.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+
+		m := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+		r, rtt, err := exchange(context.Background(), m, c)
+		if (err == nil) != test.ok {
+			t.Errorf("exchange(%s): got %v, want success %v", test.server, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if r.Id != m.Id || len(r.Answer) == 0 {
+			t.Errorf("exchange(%s): got id %d with %d answers, want id %d", test.server, r.Id, len(r.Answer), m.Id)
+		}
+		if rtt <= 0 {
+			t.Errorf("exchange(%s): got rtt %v, want > 0", test.server, rtt)
+		}
+	}
+
+	if _, err := newClient("https://doh.example#pin-sha256=foo"); err == nil {
+		t.Error("newClient() with a bad pin: got nil, want error")
+	}
+}
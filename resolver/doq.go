@@ -0,0 +1,190 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// RFC 9250 section 4.3
+	doqNoError       = 0x0
+	doqProtocolError = 0x2
+	doqALPN          = "doq"
+)
+
+// doqClient sends queries to a DoQ server (RFC 9250) reusing one connection.
+type doqClient struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn quic.EarlyConnection
+}
+
+func newDOQClient(addr string) (*doqClient, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &doqClient{
+		addr: addr,
+		tlsConfig: &tls.Config{
+			ServerName: host,
+			NextProtos: []string{doqALPN},
+			MinVersion: tls.VersionTLS13,
+			// session tickets allow 0-RTT on reconnects
+			ClientSessionCache: tls.NewLRUClientSessionCache(8),
+		},
+	}, nil
+}
+
+// connection returns the open connection or dials a new one.
+func (d *doqClient) connection(ctx context.Context) (quic.EarlyConnection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil && d.conn.Context().Err() == nil {
+		return d.conn, nil
+	}
+
+	conn, err := quic.DialAddrEarly(ctx, d.addr, d.tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: lookupTimeout,
+		MaxIdleTimeout:       30 * time.Second,
+		KeepAlivePeriod:      20 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+// drop discards conn so that the next query dials a new connection.
+func (d *doqClient) drop(conn quic.EarlyConnection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn == conn {
+		d.conn = nil
+	}
+	conn.CloseWithError(doqNoError, "")
+}
+
+// replaySafe reports if q may be sent in 0-RTT data,
+// zone transfers must not be (RFC 9250 section 4.5).
+func replaySafe(q *dns.Msg) bool {
+	for _, question := range q.Question {
+		if question.Qtype == dns.TypeAXFR || question.Qtype == dns.TypeIXFR {
+			return false
+		}
+	}
+	return q.Opcode == dns.OpcodeQuery
+}
+
+// exchangeDOQ sends m on a new stream of the DoQ connection.
+func exchangeDOQ(ctx context.Context, m *dns.Msg, c *client) (r *dns.Msg, rtt time.Duration, err error) {
+	// the message id must be 0 on DoQ
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	conn, err := c.doq.connection(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !replaySafe(q) {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	ans, err := doqRoundTrip(ctx, conn, buf)
+	if err != nil {
+		c.doq.drop(conn)
+		return nil, 0, err
+	}
+	rtt = time.Since(start)
+
+	ans.Id = m.Id
+	return ans, rtt, nil
+}
+
+func doqRoundTrip(ctx context.Context, conn quic.EarlyConnection, query []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	} else {
+		stream.SetDeadline(time.Now().Add(lookupTimeout))
+	}
+
+	if err := writeDOQMsg(stream, query); err != nil {
+		return nil, err
+	}
+	// the client indicates the end of the query with a STREAM FIN
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	b, err := readDOQMsg(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	ans := new(dns.Msg)
+	if err := ans.Unpack(b); err != nil {
+		stream.CancelRead(doqProtocolError)
+		return nil, err
+	}
+	if ans.Id != 0 {
+		return nil, errors.New("doq: response id is not 0")
+	}
+	return ans, nil
+}
+
+// writeDOQMsg writes b prefixed with its 2 byte length.
+func writeDOQMsg(w io.Writer, b []byte) error {
+	if len(b) > dns.MaxMsgSize {
+		return fmt.Errorf("doq: message too large")
+	}
+	msg := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(msg, uint16(len(b)))
+	copy(msg[2:], b)
+
+	_, err := w.Write(msg)
+	return err
+}
+
+// readDOQMsg reads a length prefixed message.
+func readDOQMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,158 @@
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqServer is an in-process DoQ server answering from testData.
+type doqServer struct {
+	ln   *quic.EarlyListener
+	cert *x509.Certificate
+
+	mu    sync.Mutex
+	conns []quic.EarlyConnection
+}
+
+func newDOQServer(t *testing.T) *doqServer {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "doq.example"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{raw}, PrivateKey: key}},
+		NextProtos:   []string{doqALPN},
+	}, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &doqServer{ln: ln, cert: cert}
+	go s.serve()
+	return s
+}
+
+func (s *doqServer) serve() {
+	for {
+		conn, err := s.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					b, err := readDOQMsg(stream)
+					if err != nil {
+						return
+					}
+					q := new(dns.Msg)
+					if err := q.Unpack(b); err != nil || q.Id != 0 {
+						conn.CloseWithError(doqProtocolError, "")
+						return
+					}
+					ans := testData[q.Question[0].Qtype][q.Question[0].Name].Copy()
+					ans.SetReply(q)
+					ans.AuthenticatedData = true
+					out, _ := ans.Pack()
+					writeDOQMsg(stream, out)
+				}()
+			}
+		}()
+	}
+}
+
+func (s *doqServer) connections() []quic.EarlyConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]quic.EarlyConnection(nil), s.conns...)
+}
+
+func TestStub_DOQ(t *testing.T) {
+	srv := newDOQServer(t)
+
+	rs, err := NewStub("quic://" + srv.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := rs.clients[0]
+	if c.d.Net != "quic" {
+		t.Fatalf("want quic, got %s", c.d.Net)
+	}
+	c.doq.tlsConfig.RootCAs = x509.NewCertPool()
+	c.doq.tlsConfig.RootCAs.AddCert(srv.cert)
+
+	ctx := context.Background()
+	ips, secure, err := rs.LookupIP(ctx, "ip", "example.com")
+	if err != nil {
+		t.Fatalf("LookupIP(): got %v, want no error", err)
+	}
+	if len(ips) == 0 || !secure {
+		t.Errorf("LookupIP(): got %v secure %v, want secure ips", ips, secure)
+	}
+	if _, _, err := rs.LookupTLSA(ctx, "443", "tcp", "example.com"); err != nil {
+		t.Fatalf("LookupTLSA(): got %v, want no error", err)
+	}
+	if n := len(srv.connections()); n != 1 {
+		t.Errorf("connections: got %d, want 1", n)
+	}
+
+	// Verify applies to DoQ responses as well
+	rs.Verify = func(m *dns.Msg) error { return errors.New("bad sig") }
+	if _, err := rs.query(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); err == nil {
+		t.Error("query() with failing Verify: got nil, want error")
+	}
+	rs.Verify = nil
+
+	// reconnecting resumes the session with 0-RTT
+	c.doq.drop(c.doq.conn)
+	m := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	r, _, err := exchangeDOQ(ctx, m, c)
+	if err != nil {
+		t.Fatalf("exchangeDOQ(): got %v, want no error", err)
+	}
+	if r.Id != m.Id {
+		t.Errorf("id: got %d, want %d", r.Id, m.Id)
+	}
+
+	conns := srv.connections()
+	if len(conns) != 2 {
+		t.Fatalf("connections: got %d, want 2", len(conns))
+	}
+	if !conns[1].ConnectionState().Used0RTT {
+		t.Error("second connection did not use 0-RTT")
+	}
+}
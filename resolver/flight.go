@@ -0,0 +1,72 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// flight deduplicates concurrent identical queries.
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done    chan struct{}
+	res     *DNSResult
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func flightKey(name string, qtype uint16) string {
+	return dns.CanonicalName(name) + "/" + dns.TypeToString[qtype]
+}
+
+// do runs fn once for concurrent callers with the same key and returns its result to
+// all of them. fn is not cancelled by a single caller going away, only once every
+// caller has, and callers return as soon as their own context is done.
+func (f *flight) do(ctx context.Context, key string, fn func(ctx context.Context) *DNSResult) *DNSResult {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]*call)
+	}
+	c, ok := f.calls[key]
+	if !ok {
+		fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lookupTimeout)
+		c = &call{done: make(chan struct{}), cancel: cancel}
+		f.calls[key] = c
+
+		go func() {
+			c.res = fn(fctx)
+			cancel()
+
+			f.mu.Lock()
+			if f.calls[key] == c {
+				delete(f.calls, key)
+			}
+			f.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	f.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.res
+	case <-ctx.Done():
+		f.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody waits anymore, later callers start a new query
+			c.cancel()
+			if f.calls[key] == c {
+				delete(f.calls, key)
+			}
+		}
+		f.mu.Unlock()
+		return &DNSResult{Err: ctx.Err()}
+	}
+}
@@ -0,0 +1,245 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// HNSRootAnchor is the DS of the key signing the Handshake
+// root zone served by hsd and hnsd.
+const HNSRootAnchor = `. IN DS 35215 13 2 7C50EA94A63AEECB65B510D1EAC1846C973A89D4AB292287D5A4D715136B57A3`
+
+const (
+	// referrals followed for a single query
+	maxReferrals = 16
+	// nested queries for cname targets and name server addresses
+	maxDepth = 8
+)
+
+var errTooDeep = errors.New("iterative: too many nested queries")
+
+// NewHNSD creates a validating resolver iterating from the root
+// server of hnsd at addr down to the authoritative servers. The
+// root zone served by hnsd is verified against the Handshake chain
+// and anchors the validation of the TLD delegations.
+func NewHNSD(addr string) (*Validating, error) {
+	addr, err := parseSimpleAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	it := newIterator(addr)
+	v := newValidating(it.exchange)
+	if err := v.AddTA(HNSRootAnchor); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// iterator resolves queries from the authoritative
+// servers starting at a root server.
+type iterator struct {
+	root string
+	// rootFunc answers instead of the root server when set
+	rootFunc func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	udp      *dns.Client
+	tcp      *dns.Client
+
+	exchangeFunc func(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error)
+}
+
+func newIterator(root string) *iterator {
+	it := &iterator{
+		root: root,
+		udp:  &dns.Client{Timeout: lookupTimeout / 2},
+		tcp:  &dns.Client{Net: "tcp", Timeout: lookupTimeout / 2},
+	}
+	it.exchangeFunc = it.exchangeServer
+	return it
+}
+
+// exchangeServer queries a server, truncated answers are retried over tcp.
+func (it *iterator) exchangeServer(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+	r, _, err := it.udp.ExchangeContext(ctx, m, server)
+	if err == nil && r.Truncated {
+		r, _, err = it.tcp.ExchangeContext(ctx, m, server)
+	}
+	return r, err
+}
+
+func (it *iterator) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return it.resolve(ctx, m, 0)
+}
+
+func (it *iterator) resolve(ctx context.Context, m *dns.Msg, depth int) (*dns.Msg, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	q := m.Question[0]
+	servers := []string{it.root}
+	zone := "."
+	for i := 0; i < maxReferrals; i++ {
+		r, err := it.ask(ctx, m, servers)
+		if err != nil {
+			return nil, err
+		}
+
+		cut, hosts := referral(r, zone, q.Name)
+		// the parent answers for the DS of its child
+		if cut == "" || (q.Qtype == dns.TypeDS && equalName(cut, q.Name)) {
+			return it.chase(ctx, m, r, depth)
+		}
+
+		if servers, err = it.addresses(ctx, r, cut, hosts, depth); err != nil {
+			return nil, fmt.Errorf("iterative: %s: %v", cut, err)
+		}
+		zone = cut
+	}
+
+	return nil, fmt.Errorf("iterative: too many referrals for %s", q.Name)
+}
+
+// ask queries servers in order until one answers.
+func (it *iterator) ask(ctx context.Context, m *dns.Msg, servers []string) (*dns.Msg, error) {
+	m = m.Copy()
+	m.Id = dns.Id()
+	m.RecursionDesired = false
+
+	var err error
+	for _, server := range servers {
+		var r *dns.Msg
+		if server == it.root && it.rootFunc != nil {
+			r, err = it.rootFunc(ctx, m)
+		} else {
+			r, err = it.exchangeFunc(ctx, m, server)
+		}
+		if err == nil && r.Rcode != dns.RcodeServerFailure && r.Rcode != dns.RcodeRefused {
+			return r, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[r.Rcode])
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// chase follows a cname to another zone, the answer
+// is appended to the cname chain.
+func (it *iterator) chase(ctx context.Context, m *dns.Msg, r *dns.Msg, depth int) (*dns.Msg, error) {
+	q := m.Question[0]
+	if q.Qtype == dns.TypeCNAME || r.Rcode != dns.RcodeSuccess {
+		return r, nil
+	}
+
+	target := q.Name
+	for i := 0; i < maxDepth; i++ {
+		next := ""
+		for _, rr := range r.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && equalName(c.Hdr.Name, target) {
+				next = c.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if equalName(target, q.Name) {
+		return r, nil
+	}
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == q.Qtype && equalName(rr.Header().Name, target) {
+			return r, nil
+		}
+	}
+
+	next := m.Copy()
+	next.Question[0].Name = target
+	res, err := it.resolve(ctx, next, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	res.Question = m.Question
+	res.Answer = append(append([]dns.RR(nil), r.Answer...), res.Answer...)
+	return res, nil
+}
+
+// addresses returns the addresses of the name servers hosts,
+// from the glue of r at or below cut or resolved from the root.
+func (it *iterator) addresses(ctx context.Context, r *dns.Msg, cut string, hosts []string, depth int) ([]string, error) {
+	var addrs []string
+	for _, rr := range r.Extra {
+		// glue out of bailiwick could point any name elsewhere
+		if !dns.IsSubDomain(cut, rr.Header().Name) {
+			continue
+		}
+		for _, h := range hosts {
+			if !equalName(rr.Header().Name, h) {
+				continue
+			}
+			switch t := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.JoinHostPort(t.A.String(), "53"))
+			case *dns.AAAA:
+				addrs = append(addrs, net.JoinHostPort(t.AAAA.String(), "53"))
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	var err error
+	for _, h := range hosts {
+		m := new(dns.Msg)
+		m.SetQuestion(h, dns.TypeA)
+		var res *dns.Msg
+		if res, err = it.resolve(ctx, m, depth+1); err != nil {
+			continue
+		}
+		for _, rr := range res.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no name server addresses")
+	}
+	return nil, err
+}
+
+// referral returns the zone cut below zone a response delegates
+// name to and its name servers, or an empty cut for an answer.
+func referral(r *dns.Msg, zone, name string) (string, []string) {
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0 {
+		return "", nil
+	}
+
+	var cut string
+	var hosts []string
+	for _, rr := range r.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok || equalName(ns.Hdr.Name, zone) || !dns.IsSubDomain(zone, ns.Hdr.Name) ||
+			!dns.IsSubDomain(ns.Hdr.Name, name) {
+			continue
+		}
+		if cut != "" && !equalName(cut, ns.Hdr.Name) {
+			continue
+		}
+		cut = ns.Hdr.Name
+		hosts = append(hosts, ns.Ns)
+	}
+	return cut, hosts
+}
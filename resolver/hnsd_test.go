@@ -0,0 +1,83 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIterator(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	ds := example.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+
+	referral := &dns.Msg{
+		Ns:    append(testRRs("example. 3600 IN NS ns.example."), root.sign(t, ds)...),
+		Extra: testRRs("ns.example. 3600 IN A 10.0.0.53"),
+	}
+	servers := map[string]map[string]*dns.Msg{
+		"127.0.0.1:5350": {
+			"./DNSKEY":         {Answer: root.sign(t, root.key)},
+			"example./DS":      {Answer: root.sign(t, ds)},
+			"www.example./A":   referral,
+			"alias.example./A": referral,
+			"example./DNSKEY":  referral,
+			"ns.example./A":    referral,
+			"www.other./A": {
+				Ns:    testRRs("other. 3600 IN NS ns.example."),
+				Extra: testRRs("ns.example. 3600 IN A 10.0.0.66"),
+			},
+		},
+		"10.0.0.53:53": {
+			"example./DNSKEY":  {Answer: example.sign(t, example.key)},
+			"www.example./A":   {Answer: example.sign(t, testRR("www.example. 60 IN A 10.0.0.1"))},
+			"alias.example./A": {Answer: example.sign(t, testRR("alias.example. 60 IN CNAME www.example."))},
+			"ns.example./A":    {Answer: testRRs("ns.example. 3600 IN A 10.0.0.53")},
+			"www.other./A":     {Answer: testRRs("www.other. 60 IN A 10.0.0.2")},
+		},
+	}
+
+	it := newIterator("127.0.0.1:5350")
+	it.exchangeFunc = func(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+		q := m.Question[0]
+		if m.RecursionDesired {
+			t.Errorf("%s: want recursion desired unset", q.Name)
+		}
+		r, ok := servers[server][q.Name+"/"+dns.TypeToString[q.Qtype]]
+		if !ok {
+			return nil, errors.New("unexpected query to " + server + ": " + q.Name + " " + dns.TypeToString[q.Qtype])
+		}
+		r = r.Copy()
+		r.SetReply(m)
+		return r, nil
+	}
+	v := newValidating(it.exchange)
+	if err := v.AddTA(root.key.ToDS(dns.SHA256).String()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"www.example", "alias.example"} {
+		res := v.lookup(context.Background(), name, dns.TypeA)
+		if res.Err != nil {
+			t.Fatalf("%s: %v", name, res.Err)
+		}
+		if !res.Secure || len(res.Records) == 0 {
+			t.Errorf("%s: got %+v, want a secure answer", name, res)
+		}
+	}
+
+	// glue outside of the delegated zone is ignored, ns.example
+	// is resolved from the root instead
+	m := new(dns.Msg)
+	m.SetQuestion("www.other.", dns.TypeA)
+	if _, err := it.exchange(context.Background(), m); err != nil {
+		t.Errorf("www.other: got %v, want no error", err)
+	}
+
+	if _, err := NewHNSD("127.0.0.1:5350"); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+}
@@ -0,0 +1,163 @@
+package resolver
+
+import (
+	"context"
+	"encoding/base32"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resources are cached for as long as hsd serves them
+const resourceTTL = 6 * time.Hour
+
+// NewHSD creates a validating resolver iterating from the TLD
+// delegations returned by resource, like a root server would
+// serve them. resource returns the NS, DS, glue and TXT records
+// of a Handshake TLD from a trusted full node, or none if the
+// TLD doesn't exist. Its DS records anchor the TLD zones.
+func NewHSD(resource func(ctx context.Context, tld string) ([]dns.RR, error)) *Validating {
+	return newHSD(resource, newIterator("hsd"))
+}
+
+func newHSD(resource func(ctx context.Context, tld string) ([]dns.RR, error), it *iterator) *Validating {
+	h := &hsdRoot{resource: resource, cache: newCache(maxCache)}
+	it.rootFunc = h.exchange
+
+	v := newValidating(it.exchange)
+	v.anchorFunc = h.anchors
+	return v
+}
+
+type hsdRoot struct {
+	resource func(ctx context.Context, tld string) ([]dns.RR, error)
+	cache    *cache
+	flight   flight
+}
+
+func (h *hsdRoot) records(ctx context.Context, tld string) ([]dns.RR, error) {
+	key := flightKey(tld, dns.TypeANY)
+	if e, ok := h.cache.get(key); ok && time.Now().Before(e.ttl) {
+		return e.msg, nil
+	}
+
+	res := h.flight.do(ctx, key, func(ctx context.Context) *DNSResult {
+		rrs, err := h.resource(ctx, tld)
+		if err != nil {
+			return &DNSResult{Err: err}
+		}
+		h.cache.set(key, &entry{msg: rrs, ttl: time.Now().Add(resourceTTL)})
+		return &DNSResult{Records: rrs, Secure: true}
+	})
+	return res.Records, res.Err
+}
+
+// anchors returns the DS records of a TLD.
+func (h *hsdRoot) anchors(ctx context.Context, zone string) ([]dns.RR, bool, error) {
+	if dns.CountLabel(zone) != 1 {
+		return nil, false, nil
+	}
+	rrs, err := h.records(ctx, dns.CanonicalName(zone))
+	if err != nil {
+		return nil, false, err
+	}
+
+	var ds []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeDS {
+			ds = append(ds, rr)
+		}
+	}
+	return ds, true, nil
+}
+
+// exchange answers m from the resource of its TLD, with a referral
+// to the TLD name servers for names below it.
+func (h *hsdRoot) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	q := m.Question[0]
+	r := new(dns.Msg)
+	r.SetReply(m)
+
+	labels := dns.SplitDomainName(q.Name)
+	if len(labels) == 0 {
+		return r, nil
+	}
+	tld := dns.Fqdn(dns.CanonicalName(labels[len(labels)-1]))
+	if tld == synthTLD {
+		return synth(r, labels), nil
+	}
+	rrs, err := h.records(ctx, tld)
+	if err != nil {
+		return nil, err
+	}
+	if len(rrs) == 0 {
+		r.Rcode = dns.RcodeNameError
+		return r, nil
+	}
+
+	var ns, glue, answer []dns.RR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		switch {
+		case hdr.Rrtype == dns.TypeNS:
+			ns = append(ns, rr)
+		case !equalName(hdr.Name, tld):
+			glue = append(glue, rr)
+		case equalName(q.Name, tld) && hdr.Rrtype == q.Qtype:
+			answer = append(answer, rr)
+		case hdr.Rrtype == dns.TypeDS:
+			// sent along with the referral
+		}
+	}
+
+	// the DS and TXT of the TLD itself are answered from the resource
+	if len(answer) > 0 || len(ns) == 0 || (equalName(q.Name, tld) && q.Qtype == dns.TypeDS) {
+		r.Authoritative = true
+		r.Answer = answer
+		return r, nil
+	}
+
+	r.Ns = ns
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeDS {
+			r.Ns = append(r.Ns, rr)
+		}
+	}
+	r.Extra = glue
+	return r, nil
+}
+
+// synthTLD holds the name servers hsd synthesizes
+// for the SYNTH4 and SYNTH6 records of a resource.
+const synthTLD = "_synth."
+
+var synthEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// synth answers r for a name below synthTLD from the address encoded
+// in its label, the way the hsd and hnsd root servers do.
+func synth(r *dns.Msg, labels []string) *dns.Msg {
+	q := r.Question[0]
+	var ip net.IP
+	if len(labels) == 2 && strings.HasPrefix(labels[0], "_") {
+		raw, err := synthEncoding.DecodeString(strings.ToUpper(labels[0][1:]))
+		if err == nil && (len(raw) == net.IPv4len || len(raw) == net.IPv6len) {
+			ip = raw
+		}
+	}
+	if ip == nil {
+		r.Rcode = dns.RcodeNameError
+		return r
+	}
+
+	r.Authoritative = true
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: uint32(resourceTTL.Seconds())}
+	switch {
+	case q.Qtype == dns.TypeA && len(ip) == net.IPv4len:
+		r.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip}}
+	case q.Qtype == dns.TypeAAAA && len(ip) == net.IPv6len:
+		r.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+	}
+	return r
+}
@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHSD(t *testing.T) {
+	example := newTestZone(t, "example.")
+	ds := example.key.ToDS(dns.SHA256)
+
+	resources := map[string][]dns.RR{
+		"example.":  append(testRRs("example. 21600 IN NS ns.example.", "ns.example. 21600 IN A 10.0.0.53"), ds),
+		"insecure.": testRRs("insecure. 21600 IN NS ns.insecure.", "ns.insecure. 21600 IN A 10.0.0.54"),
+		// SYNTH4 10.0.0.54
+		"synth.": testRRs("synth. 21600 IN NS _18000dg._synth.", "_18000dg._synth. 21600 IN A 10.0.0.54"),
+	}
+	var calls int32
+	resource := func(ctx context.Context, tld string) ([]dns.RR, error) {
+		atomic.AddInt32(&calls, 1)
+		return resources[tld], nil
+	}
+
+	servers := map[string]map[string]*dns.Msg{
+		"10.0.0.53:53": {
+			"example./DNSKEY": {Answer: example.sign(t, example.key)},
+			"www.example./A":  {Answer: example.sign(t, testRR("www.example. 60 IN A 10.0.0.1"))},
+		},
+		"10.0.0.54:53": {
+			"www.insecure./A":  {Answer: testRRs("www.insecure. 60 IN A 10.0.0.2")},
+			"www.insecure./DS": {Ns: testRRs("insecure. 300 IN SOA ns.insecure. admin.insecure. 1 7200 3600 1209600 300")},
+			"www.synth./A":     {Answer: testRRs("www.synth. 60 IN A 10.0.0.3")},
+			"www.synth./DS":    {Ns: testRRs("synth. 300 IN SOA _18000dg._synth. admin.synth. 1 7200 3600 1209600 300")},
+		},
+	}
+	it := newIterator("hsd")
+	it.exchangeFunc = func(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+		q := m.Question[0]
+		r, ok := servers[server][q.Name+"/"+dns.TypeToString[q.Qtype]]
+		if !ok {
+			return nil, errors.New("unexpected query to " + server + ": " + q.Name + " " + dns.TypeToString[q.Qtype])
+		}
+		r = r.Copy()
+		r.SetReply(m)
+		return r, nil
+	}
+	v := newHSD(resource, it)
+
+	tests := []struct {
+		name   string
+		secure bool
+		nx     bool
+	}{
+		{"www.example", true, false},
+		{"www.insecure", false, false},
+		{"www.synth", false, false},
+		{"www.nonexistent", false, true},
+	}
+	for _, tt := range tests {
+		res := v.lookup(context.Background(), tt.name, dns.TypeA)
+		if res.Err != nil {
+			t.Fatalf("%s: %v", tt.name, res.Err)
+		}
+		if res.Secure != tt.secure {
+			t.Errorf("%s: got secure %v, want %v", tt.name, res.Secure, tt.secure)
+		}
+		if got := len(res.Records) == 0; got != tt.nx {
+			t.Errorf("%s: got %d records", tt.name, len(res.Records))
+		}
+	}
+
+	// resources are cached
+	if got := atomic.LoadInt32(&calls); got != 4 {
+		t.Errorf("got %d resource calls, want 4", got)
+	}
+}
@@ -0,0 +1,171 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queries on encrypted transports are padded to a
+// multiple of paddingBlock octets (RFC 8467 section 4.1)
+const paddingBlock = 128
+
+var errQuestionMismatch = errors.New("response question does not match the query")
+
+// exchange sends m to the upstream of c, padding queries on encrypted transports
+// and adding cookies and optionally randomizing the name case on plain ones.
+// The question section of the response must match the query.
+func (s *Stub) exchange(ctx context.Context, m *dns.Msg, c *client) (*dns.Msg, time.Duration, error) {
+	q := m.Copy()
+	randomized := false
+	switch c.d.Net {
+	case "tcp-tls", "https", "quic":
+		pad(q, paddingBlock)
+	case "", "udp":
+		if s.Randomize0x20 {
+			q.Question[0].Name = randomizeCase(q.Question[0].Name)
+			randomized = true
+		}
+	}
+	if c.cookie != nil {
+		c.cookie.add(q)
+	}
+
+	r, rtt, err := exchange(ctx, q, c)
+	if err == nil {
+		err = checkQuestion(q, r, randomized)
+	}
+	if err == nil && c.cookie != nil {
+		err = c.cookie.update(r)
+		// retry once with the server cookie sent along (RFC 7873 section 5.3)
+		if err == nil && r.Rcode == dns.RcodeBadCookie {
+			c.cookie.add(q)
+			if r, rtt, err = exchange(ctx, q, c); err == nil {
+				err = checkQuestion(q, r, randomized)
+			}
+			if err == nil {
+				err = c.cookie.update(r)
+			}
+		}
+	}
+	if err != nil {
+		return nil, rtt, err
+	}
+
+	r.Question = m.Question
+	return r, rtt, nil
+}
+
+// checkQuestion checks r answers the question of q, randomized names
+// must be echoed with the same case (draft-vixie-dnsext-dns0x20).
+func checkQuestion(q, r *dns.Msg, randomized bool) error {
+	if !r.Response || len(r.Question) != 1 || len(q.Question) != 1 {
+		return errQuestionMismatch
+	}
+	want, got := q.Question[0], r.Question[0]
+	if want.Qtype != got.Qtype || want.Qclass != got.Qclass {
+		return errQuestionMismatch
+	}
+	if randomized && want.Name != got.Name {
+		return errQuestionMismatch
+	}
+	if !strings.EqualFold(want.Name, got.Name) {
+		return errQuestionMismatch
+	}
+	return nil
+}
+
+// randomizeCase randomizes the case of the letters of name.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			if mrand.Intn(2) == 0 {
+				b[i] = c | 0x20
+			} else {
+				b[i] = c &^ 0x20
+			}
+		}
+	}
+	return string(b)
+}
+
+// pad adds an EDNS padding option to m so that its
+// length is a multiple of block (RFC 7830).
+func pad(m *dns.Msg, block int) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(udpSize, false)
+		opt = m.IsEdns0()
+	}
+	// the option code and length take 4 octets
+	n := (block - (m.Len()+4)%block) % block
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, n)})
+}
+
+// cookie is the DNS cookie state of an upstream (RFC 7873).
+type cookie struct {
+	mu     sync.Mutex
+	client string
+	server string
+}
+
+func newCookie() (*cookie, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &cookie{client: hex.EncodeToString(b)}, nil
+}
+
+// add sets the cookie option of m to the client
+// cookie and the last server cookie if any.
+func (c *cookie) add(m *dns.Msg) {
+	c.mu.Lock()
+	value := c.client + c.server
+	c.mu.Unlock()
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(udpSize, false)
+		opt = m.IsEdns0()
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_COOKIE); ok {
+			e.Cookie = value
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: value})
+}
+
+// update stores the server cookie of r, responses echoing
+// another client cookie are rejected as spoofed.
+func (c *cookie) update(r *dns.Msg) error {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		// 8 octets of client cookie and 8 to 32 of server cookie
+		if len(e.Cookie) < 32 || len(e.Cookie) > 80 || !strings.EqualFold(e.Cookie[:16], c.client) {
+			return fmt.Errorf("bad cookie in response: %s", e.Cookie)
+		}
+		c.mu.Lock()
+		c.server = e.Cookie[16:]
+		c.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// serveUDP answers queries on a local udp server with handler.
+func serveUDP(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestPad(t *testing.T) {
+	for _, name := range []string{"a.", "example.com.", strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "."} {
+		m := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		pad(m, paddingBlock)
+		if m.Len()%paddingBlock != 0 {
+			t.Fatalf("%s: got length %d, want a multiple of %d", name, m.Len(), paddingBlock)
+		}
+	}
+}
+
+func TestStub_Exchange(t *testing.T) {
+	const serverCookie = "0102030405060708"
+	var (
+		mu    sync.Mutex
+		asked []string
+		spoof bool
+	)
+	addr := serveUDP(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		asked = append(asked, q.Question[0].Name)
+		r := new(dns.Msg).SetReply(q)
+		if spoof {
+			r.Question[0].Name = "example.org."
+		}
+
+		var c *dns.EDNS0_COOKIE
+		for _, o := range q.IsEdns0().Option {
+			if e, ok := o.(*dns.EDNS0_COOKIE); ok {
+				c = e
+			}
+		}
+		if c == nil {
+			t.Error("got no cookie, want a client cookie")
+			return
+		}
+		r.SetEdns0(udpSize, false)
+		r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: c.Cookie[:16] + serverCookie})
+		if c.Cookie[16:] != serverCookie {
+			r.Rcode = dns.RcodeBadCookie
+		} else {
+			r.Answer = testRRs(q.Question[0].Name + " 60 IN A 192.0.2.1")
+		}
+		w.WriteMsg(r)
+	})
+
+	rs, err := NewStub(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Randomize0x20 = true
+
+	name := "randomized-case-example.com."
+	m := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	m.SetEdns0(udpSize, false)
+	r, err := rs.query(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	got := asked
+	spoof = true
+	mu.Unlock()
+
+	// the first query has no server cookie
+	if len(got) != 2 || len(r.Answer) != 1 {
+		t.Fatalf("got %d queries and %d answers, want 2 and 1", len(got), len(r.Answer))
+	}
+	if r.Question[0].Name != name {
+		t.Fatalf("got question %s, want %s", r.Question[0].Name, name)
+	}
+	if got[0] == name && got[1] == name {
+		t.Fatalf("got %v, want randomized case", got)
+	}
+
+	if _, err := rs.query(context.Background(), m); err == nil {
+		t.Fatal("got no error for a mismatched question, want error")
+	}
+}
+
+func TestCheckQuestion(t *testing.T) {
+	q := new(dns.Msg).SetQuestion("ExAmple.com.", dns.TypeA)
+	tests := []struct {
+		name       string
+		qtype      uint16
+		randomized bool
+		ok         bool
+	}{
+		{"ExAmple.com.", dns.TypeA, true, true},
+		{"example.com.", dns.TypeA, false, true},
+		{"example.com.", dns.TypeA, true, false},
+		{"ExAmple.com.", dns.TypeAAAA, false, false},
+		{"example.org.", dns.TypeA, false, false},
+	}
+	for _, tc := range tests {
+		r := new(dns.Msg).SetReply(q)
+		r.Question[0].Name, r.Question[0].Qtype = tc.name, tc.qtype
+		if err := checkQuestion(q, r, tc.randomized); (err == nil) != tc.ok {
+			t.Fatalf("%s %s: got %v, want ok = %v", tc.name, dns.TypeToString[tc.qtype], err, tc.ok)
+		}
+	}
+}
@@ -15,6 +15,7 @@ import (
 type Recursive struct {
 	ub     *unbound.Unbound
 	resolv func(name string, rrtype, rrclass uint16) (*unbound.Result, error)
+	flight flight
 	DefaultResolver
 }
 
@@ -47,16 +48,27 @@ func (r *Recursive) ResolvConf(name string) error {
 	return r.ub.ResolvConf(name)
 }
 
+// Config reads an unbound configuration file.
+func (r *Recursive) Config(file string) error {
+	return r.ub.Config(file)
+}
+
 func (r *Recursive) lookup(ctx context.Context, name string, qtype uint16) *DNSResult {
-	result := make(chan DNSResult, 1)
-	go r.cgoLookup(name, qtype, result)
-
-	select {
-	case r := <-result:
-		return &r
-	case <-ctx.Done():
-		return &DNSResult{nil, false, fmt.Errorf("unbound: context error: %w", ctx.Err())}
+	res := r.flight.do(ctx, flightKey(name, qtype), func(ctx context.Context) *DNSResult {
+		result := make(chan DNSResult, 1)
+		go r.cgoLookup(name, qtype, result)
+
+		select {
+		case r := <-result:
+			return &r
+		case <-ctx.Done():
+			return &DNSResult{Err: fmt.Errorf("unbound: context error: %w", ctx.Err())}
+		}
+	})
+	if res.Err != nil && ctx.Err() != nil {
+		return &DNSResult{Err: fmt.Errorf("unbound: context error: %w", ctx.Err())}
 	}
+	return res
 }
 
 func (r *Recursive) cgoLookup(name string, qtype uint16, result chan<- DNSResult) {
@@ -79,9 +91,20 @@ func (r *Recursive) cgoLookup(name string, qtype uint16, result chan<- DNSResult
 		return
 	}
 
+	// unbound only returns the final records, the chain
+	// is kept as a single CNAME for LookupCNAME
+	records := res.Rr
+	if res.CanonName != "" && !equalName(res.CanonName, name) {
+		records = append([]dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: res.Ttl},
+			Target: dns.Fqdn(res.CanonName),
+		}}, records...)
+	}
+
 	result <- DNSResult{
-		Secure:  res.Secure,
-		Records: res.Rr,
+		Secure:   res.Secure,
+		Records:  records,
+		NXDomain: res.NxDomain,
 	}
 }
 
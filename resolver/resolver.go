@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -21,15 +22,39 @@ type Resolver interface {
 	// It returns a slice of that name's TLSA records and
 	// whether the lookup was secure.
 	LookupTLSA(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error)
+
+	// LookupSVCB looks up SVCB records for the given name.
+	// It returns a slice of that name's SVCB records and
+	// whether the lookup was secure.
+	LookupSVCB(ctx context.Context, name string) ([]*dns.SVCB, bool, error)
+
+	// LookupHTTPS looks up HTTPS records for the given name.
+	// It returns a slice of that name's HTTPS records and
+	// whether the lookup was secure.
+	LookupHTTPS(ctx context.Context, name string) ([]*dns.HTTPS, bool, error)
+
+	// LookupCNAME returns the canonical name of host, the final target of
+	// its CNAME chain or host itself, and whether the lookup was secure.
+	LookupCNAME(ctx context.Context, host string) (string, bool, error)
+
+	// Lookup looks up records of any type for the given name.
+	// The result tells whether the lookup was secure and
+	// whether the name exists.
+	Lookup(ctx context.Context, name string, qtype uint16) *DNSResult
 }
 
 var ErrUnboundNotAvail = errors.New("unbound not available")
 var ErrServFail = errors.New("dns lookup failed (rcode: servfail)")
+var ErrBogus = errors.New("dnssec validation failed")
 
 type DNSResult struct {
 	Records []dns.RR
 	Secure  bool
 	Err     error
+	// NXDomain is set if the name doesn't exist
+	NXDomain bool
+	// Authority holds the SOA of negative answers (RFC 2308)
+	Authority []dns.RR
 }
 
 type DefaultResolver struct {
@@ -119,6 +144,92 @@ func (r *DefaultResolver) LookupTLSA(ctx context.Context, service, proto, name s
 	return rrs, result.Secure, nil
 }
 
+// LookupSVCB looks up SVCB records for the given name.
+// It returns a slice of that name's SVCB records and
+// whether the lookup was secure.
+func (r *DefaultResolver) LookupSVCB(ctx context.Context, name string) ([]*dns.SVCB, bool, error) {
+	if parseIP(name) != nil {
+		return []*dns.SVCB{}, false, nil
+	}
+
+	result := r.Query(ctx, dns.Fqdn(name), dns.TypeSVCB)
+	if result.Err != nil {
+		return nil, false, result.Err
+	}
+
+	var rrs []*dns.SVCB
+	for _, rr := range result.Records {
+		switch t := rr.(type) {
+		case *dns.SVCB:
+			rrs = append(rrs, t)
+		}
+	}
+
+	return rrs, result.Secure, nil
+}
+
+// LookupHTTPS looks up HTTPS records for the given name.
+// It returns a slice of that name's HTTPS records and
+// whether the lookup was secure.
+func (r *DefaultResolver) LookupHTTPS(ctx context.Context, name string) ([]*dns.HTTPS, bool, error) {
+	if parseIP(name) != nil {
+		return []*dns.HTTPS{}, false, nil
+	}
+
+	result := r.Query(ctx, dns.Fqdn(name), dns.TypeHTTPS)
+	if result.Err != nil {
+		return nil, false, result.Err
+	}
+
+	var rrs []*dns.HTTPS
+	for _, rr := range result.Records {
+		switch t := rr.(type) {
+		case *dns.HTTPS:
+			rrs = append(rrs, t)
+		}
+	}
+
+	return rrs, result.Secure, nil
+}
+
+// LookupCNAME returns the canonical name of host, the final target of
+// its CNAME chain or host itself, and whether the lookup was secure.
+func (r *DefaultResolver) LookupCNAME(ctx context.Context, host string) (string, bool, error) {
+	name := dns.Fqdn(host)
+	if parseIP(host) != nil {
+		return name, false, nil
+	}
+
+	result := r.Query(ctx, name, dns.TypeA)
+	if result.Err != nil {
+		return "", false, result.Err
+	}
+
+	// the answer holds the chain in any order
+	for range result.Records {
+		next := ""
+		for _, rr := range result.Records {
+			if t, ok := rr.(*dns.CNAME); ok && strings.EqualFold(t.Hdr.Name, name) {
+				next = t.Target
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	return name, result.Secure, nil
+}
+
+// Lookup looks up records of any type for the given name.
+// The result tells whether the lookup was secure and
+// whether the name exists.
+func (r *DefaultResolver) Lookup(ctx context.Context, name string, qtype uint16) *DNSResult {
+	return r.Query(ctx, dns.Fqdn(name), qtype)
+}
+
 func parseIP(name string) net.IP {
 	if name == "" {
 		return nil
@@ -320,7 +320,7 @@ func TestResolver_LookupIP(t *testing.T) {
 				err = ErrServFail
 			}
 
-			return &DNSResult{reply.Answer, reply.AuthenticatedData, err}
+			return &DNSResult{Records: reply.Answer, Secure: reply.AuthenticatedData, Err: err}
 		},
 	}
 
@@ -347,6 +347,72 @@ func TestResolver_LookupIP(t *testing.T) {
 	}
 }
 
+func TestResolver_LookupHTTPS(t *testing.T) {
+	answer := testRRs(
+		"example.com. IN HTTPS 1 . alpn=h2 echconfig=AAEC",
+		"example.com. IN RRSIG HTTPS 13 2 300 20300101000000 20200101000000 1 example.com. AAAA",
+	)
+	r := DefaultResolver{
+		Query: func(ctx context.Context, qname string, qtype uint16) *DNSResult {
+			if qtype != dns.TypeHTTPS {
+				t.Fatalf("got qtype = %s, want qtype = HTTPS", dns.TypeToString[qtype])
+			}
+			if qname != "example.com." {
+				t.Fatalf("got qname = %s, want example.com.", qname)
+			}
+			return &DNSResult{Records: answer, Secure: true}
+		},
+	}
+
+	rrs, secure, err := r.LookupHTTPS(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secure {
+		t.Fatal("got secure = false, want true")
+	}
+	if len(rrs) != 1 || rrs[0].Priority != 1 {
+		t.Fatalf("got answer = %v, want %v", rrs, answer[:1])
+	}
+
+	if rrs, _, _ := r.LookupHTTPS(context.Background(), "192.0.2.1"); len(rrs) != 0 {
+		t.Fatalf("got answer = %v for an ip address, want none", rrs)
+	}
+}
+
+func TestResolver_LookupCNAME(t *testing.T) {
+	r := DefaultResolver{
+		Query: func(ctx context.Context, qname string, qtype uint16) *DNSResult {
+			if qtype != dns.TypeA {
+				t.Fatalf("got qtype = %s, want qtype = A", dns.TypeToString[qtype])
+			}
+			return &DNSResult{Records: testRRs(
+				"b.example.net. IN CNAME c.example.org.",
+				"www.example.com. IN CNAME b.example.net.",
+				"c.example.org. IN A 192.0.2.1",
+			), Secure: true}
+		},
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"www.example.com", "c.example.org."},
+		{"b.example.net.", "c.example.org."},
+		{"c.example.org", "c.example.org."},
+	}
+	for _, tc := range tests {
+		got, secure, err := r.LookupCNAME(context.Background(), tc.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want || !secure {
+			t.Fatalf("got %s secure = %v, want %s secure", got, secure, tc.want)
+		}
+	}
+}
+
 func testRRs(args ...string) []dns.RR {
 	var out []dns.RR
 	for _, arg := range args {
@@ -0,0 +1,142 @@
+package resolver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// Server answers DNS and DoH queries with a Resolver, its
+// answers are authenticated (AD) only if the lookup was secure.
+type Server struct {
+	Resolver Resolver
+}
+
+// ServeDNS implements dns.Handler.
+func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	r := s.Answer(ctx, q)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := q.IsEdns0(); opt != nil {
+			size = max(int(opt.UDPSize()), dns.MinMsgSize)
+		}
+		r.Truncate(size)
+	}
+	w.WriteMsg(r)
+}
+
+// ServeHTTP answers RFC 8484 GET and POST DoH queries.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var b []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		b, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if ct := req.Header.Get("content-type"); ct != dohMediaType {
+			http.Error(w, fmt.Sprintf("unsupported content type %s", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err = io.ReadAll(io.LimitReader(req.Body, dohMaxSize))
+	default:
+		w.Header().Set("allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		http.Error(w, fmt.Sprintf("bad dns message: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), lookupTimeout)
+	defer cancel()
+
+	r := s.Answer(ctx, q)
+	out, err := r.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", dohMediaType)
+	// answers are cacheable for their smallest ttl (RFC 8484 section 5.1)
+	if r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError {
+		w.Header().Set("cache-control", fmt.Sprintf("max-age=%d", int(getMinTTL(r, maxTTL).Seconds())))
+	}
+	w.Write(out)
+}
+
+// Answer returns the response to the query q.
+func (s *Server) Answer(ctx context.Context, q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+
+	opt := q.IsEdns0()
+	do := opt != nil && opt.Do()
+	if opt != nil {
+		if opt.Version() != 0 {
+			r.Rcode = dns.RcodeBadVers
+			r.SetEdns0(udpSize, do)
+			return r
+		}
+		r.SetEdns0(udpSize, do)
+	}
+
+	switch {
+	case q.Opcode != dns.OpcodeQuery:
+		r.Rcode = dns.RcodeNotImplemented
+		return r
+	case len(q.Question) != 1:
+		r.Rcode = dns.RcodeFormatError
+		return r
+	}
+
+	question := q.Question[0]
+	switch {
+	case question.Qclass != dns.ClassINET:
+		r.Rcode = dns.RcodeRefused
+		return r
+	case question.Qtype == dns.TypeANY || question.Qtype == dns.TypeAXFR || question.Qtype == dns.TypeIXFR:
+		r.Rcode = dns.RcodeNotImplemented
+		return r
+	}
+
+	res := s.Resolver.Lookup(ctx, question.Name, question.Qtype)
+	if res.Err != nil {
+		r.Rcode = dns.RcodeServerFailure
+		return r
+	}
+	if res.NXDomain {
+		r.Rcode = dns.RcodeNameError
+	}
+	for _, rr := range res.Records {
+		// signatures are only sent to clients validating themselves
+		if rr.Header().Rrtype == dns.TypeRRSIG && !do {
+			continue
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+	// negative answers carry the SOA for negative caching (RFC 2308 section 3)
+	if len(r.Answer) == 0 {
+		r.Ns = append(r.Ns, res.Authority...)
+	}
+
+	// AD is only set for clients asking for it (RFC 6840 section 5.7)
+	r.AuthenticatedData = res.Secure && (q.AuthenticatedData || do)
+	return r
+}
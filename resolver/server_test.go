@@ -0,0 +1,159 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestServer returns a server answering secure, insecure,
+// nonexistent and large names.
+func newTestServer() *Server {
+	return &Server{Resolver: &DefaultResolver{
+		Query: func(ctx context.Context, name string, qtype uint16) *DNSResult {
+			switch name {
+			case "secure.example.":
+				return &DNSResult{Records: testRRs(name + " 60 IN A 192.0.2.1"), Secure: true}
+			case "insecure.example.":
+				return &DNSResult{Records: testRRs(name + " 60 IN A 192.0.2.2")}
+			case "nx.example.":
+				return &DNSResult{Secure: true, NXDomain: true,
+					Authority: testRRs("example. 30 IN SOA ns.example. admin.example. 1 7200 3600 1209600 30")}
+			case "large.example.":
+				var rrs []string
+				for i := 0; i < 100; i++ {
+					rrs = append(rrs, name+" 60 IN TXT \""+strings.Repeat("a", 100)+"\"")
+				}
+				return &DNSResult{Records: testRRs(rrs...), Secure: true}
+			}
+			return &DNSResult{Err: errors.New("lookup failed")}
+		},
+	}}
+}
+
+func TestServer(t *testing.T) {
+	srv := newTestServer()
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		ad      bool
+		rcode   int
+		answers int
+		wantAD  bool
+	}{
+		{"secure.example.", dns.TypeA, true, dns.RcodeSuccess, 1, true},
+		{"secure.example.", dns.TypeA, false, dns.RcodeSuccess, 1, false},
+		{"insecure.example.", dns.TypeA, true, dns.RcodeSuccess, 1, false},
+		{"nx.example.", dns.TypeA, true, dns.RcodeNameError, 0, true},
+		{"fail.example.", dns.TypeA, true, dns.RcodeServerFailure, 0, false},
+		{"secure.example.", dns.TypeAXFR, true, dns.RcodeNotImplemented, 0, false},
+	}
+
+	addr := serveUDP(t, srv.ServeDNS)
+	c := new(dns.Client)
+	for _, tc := range tests {
+		q := new(dns.Msg).SetQuestion(tc.name, tc.qtype)
+		q.AuthenticatedData = tc.ad
+		r, _, err := c.Exchange(q, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tc.rcode || len(r.Answer) != tc.answers || r.AuthenticatedData != tc.wantAD {
+			t.Fatalf("%s %s: got %s with %d answers ad = %v, want %s with %d answers ad = %v",
+				tc.name, dns.TypeToString[tc.qtype], dns.RcodeToString[r.Rcode], len(r.Answer), r.AuthenticatedData,
+				dns.RcodeToString[tc.rcode], tc.answers, tc.wantAD)
+		}
+	}
+
+	// negative answers carry the SOA
+	r, _, err := c.Exchange(new(dns.Msg).SetQuestion("nx.example.", dns.TypeA), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("nx.example.: got authority %v, want the SOA", r.Ns)
+	}
+
+	// answers larger than the udp size are truncated
+	q := new(dns.Msg).SetQuestion("large.example.", dns.TypeTXT)
+	r, _, err = c.Exchange(q, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Compress = true
+	if !r.Truncated || r.Len() > dns.MinMsgSize {
+		t.Fatalf("got truncated = %v with length %d, want a truncated answer", r.Truncated, r.Len())
+	}
+}
+
+func TestServer_DOH(t *testing.T) {
+	srv := httptest.NewServer(newTestServer())
+	defer srv.Close()
+
+	q := new(dns.Msg).SetQuestion("secure.example.", dns.TypeA)
+	q.Id = 0
+	q.AuthenticatedData = true
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() (*http.Response, error) {
+		return http.Get(srv.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(b))
+	}
+	post := func() (*http.Response, error) {
+		return http.Post(srv.URL+"/dns-query", dohMediaType, bytes.NewReader(b))
+	}
+	for _, do := range []func() (*http.Response, error){get, post} {
+		resp, err := do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("content-type") != dohMediaType {
+			t.Fatalf("got %s %s, want 200 OK %s", resp.Status, resp.Header.Get("content-type"), dohMediaType)
+		}
+		if cc := resp.Header.Get("cache-control"); cc != "max-age=60" {
+			t.Fatalf("got cache-control %s, want max-age=60", cc)
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(body); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 || !r.AuthenticatedData || r.Id != 0 {
+			t.Fatalf("got %d answers ad = %v id = %d, want 1 answer ad = true id = 0", len(r.Answer), r.AuthenticatedData, r.Id)
+		}
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{http.MethodGet, "/dns-query?dns=invalid!", http.StatusBadRequest},
+		{http.MethodGet, "/dns-query", http.StatusBadRequest},
+		{http.MethodPut, "/dns-query", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		req, _ := http.NewRequest(tc.method, srv.URL+tc.url, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s %s: got %d, want %d", tc.method, tc.url, resp.StatusCode, tc.status)
+		}
+	}
+}
@@ -1,14 +1,13 @@
 package resolver
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -17,8 +16,24 @@ import (
 // Stub is an AD-bit aware stub resolver
 // implementing the Resolver interface
 type Stub struct {
-	rrCache map[uint16]*cache
-	client  *client
+	cache    *cache
+	flight   flight
+	clients  []*client
+	strategy Strategy
+
+	// MinTTL and MaxTTL bound how long answers are cached,
+	// NegativeTTL bounds negative answers (RFC 2308).
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	NegativeTTL time.Duration
+	// StaleTTL is how long expired answers are served when the
+	// upstreams fail (RFC 8767), zero disables serving stale answers.
+	StaleTTL time.Duration
+	// UDPSize is the EDNS buffer size advertised to the upstreams.
+	UDPSize uint16
+	// Randomize0x20 randomizes the case of the names
+	// asked over UDP, the answers must echo it.
+	Randomize0x20 bool
 
 	exchangeFunc func(ctx context.Context, m *dns.Msg, client *client) (r *dns.Msg, rtt time.Duration, err error)
 	Verify       func(m *dns.Msg) error
@@ -26,16 +41,26 @@ type Stub struct {
 }
 
 type client struct {
-	d    *dns.Client
-	addr string
+	d      *dns.Client
+	http   *http.Client
+	doq    *doqClient
+	addr   string
+	tcp    *client
+	cookie *cookie
+	verify func(m *dns.Msg) error
+	health health
 }
 
 const (
 	maxAttempts = 3
 	minTTL      = 10 * time.Second
 	maxTTL      = 3 * time.Hour
-	// max cache len for each rr type
-	maxCache      = 5000
+	negativeTTL = time.Hour
+	staleTTL    = 24 * time.Hour
+	// DNS flag day 2020 default
+	udpSize = 1232
+	// max cache len
+	maxCache      = 15000
 	lookupTimeout = 10 * time.Second
 )
 
@@ -49,6 +74,10 @@ func parseSimpleAddr(server string) (string, error) {
 }
 
 func parseAddress(server string) (string, string, error) {
+	// drop the RFC 8484 uri template variable
+	if i := strings.Index(server, "{?dns}"); i != -1 {
+		server = server[:i] + server[i+len("{?dns}"):]
+	}
 	u, err := url.Parse(server)
 	if err != nil {
 		return "", "", fmt.Errorf("couldn't parse server address: %v", err)
@@ -67,9 +96,15 @@ func parseAddress(server string) (string, string, error) {
 	case "tls":
 		p = "tcp-tls"
 		defaultPort = "853"
+	case "quic":
+		p = u.Scheme
+		defaultPort = "853"
 	case "https":
 		p = u.Scheme
-		host = u.Scheme + "://" + u.Host
+		host = u.Scheme + "://" + u.Host + u.EscapedPath()
+		if u.RawQuery != "" {
+			host += "?" + u.RawQuery
+		}
 	default:
 		return "", "", fmt.Errorf("unsupported scheme %s", u.Scheme)
 	}
@@ -85,6 +120,45 @@ func parseAddress(server string) (string, string, error) {
 
 // NewStub creates a new stub resolver
 func NewStub(server string) (*Stub, error) {
+	return NewStubUpstreams([]Upstream{{Addr: server}}, StrategyFailover)
+}
+
+// NewStubUpstreams creates a new stub resolver querying upstreams
+// according to strategy.
+func NewStubUpstreams(upstreams []Upstream, strategy Strategy) (*Stub, error) {
+	if len(upstreams) == 0 {
+		return nil, errNoUpstreams
+	}
+
+	var clients []*client
+	for _, u := range upstreams {
+		c, err := newClient(u.Addr)
+		if err != nil {
+			return nil, err
+		}
+		c.verify = u.Verify
+		clients = append(clients, c)
+	}
+
+	stub := &Stub{
+		cache:       newCache(maxCache),
+		MinTTL:      minTTL,
+		MaxTTL:      maxTTL,
+		NegativeTTL: negativeTTL,
+		StaleTTL:    staleTTL,
+		UDPSize:     udpSize,
+		clients:     clients,
+		strategy:    strategy,
+	}
+	stub.exchangeFunc = stub.exchange
+	stub.DefaultResolver = DefaultResolver{
+		Query: stub.lookup,
+	}
+
+	return stub, nil
+}
+
+func newClient(server string) (*client, error) {
 	addr, proto, err := parseAddress(server)
 
 	if err != nil {
@@ -102,31 +176,39 @@ func NewStub(server string) (*Stub, error) {
 	c.d.Net = proto
 	c.d.Timeout = lookupTimeout
 
-	rrCache := make(map[uint16]*cache)
-	rrCache[dns.TypeA] = newCache(maxCache)
-	rrCache[dns.TypeAAAA] = newCache(maxCache)
-	rrCache[dns.TypeTLSA] = newCache(maxCache)
-
-	stub := &Stub{
-		rrCache:      rrCache,
-		client:       c,
-		exchangeFunc: exchange,
-	}
-	stub.DefaultResolver = DefaultResolver{
-		Query: stub.lookup,
+	switch proto {
+	case "https":
+		if c.http, err = newDOHClient(server); err != nil {
+			return nil, err
+		}
+	case "quic":
+		if c.doq, err = newDOQClient(addr); err != nil {
+			return nil, err
+		}
+	case "", "udp", "tcp":
+		if c.cookie, err = newCookie(); err != nil {
+			return nil, err
+		}
+		// truncated answers are retried over tcp
+		if proto != "tcp" {
+			c.tcp = &client{d: &dns.Client{Net: "tcp", Timeout: lookupTimeout}, addr: addr, cookie: c.cookie}
+		}
 	}
 
-	return stub, nil
+	return c, nil
 }
 
 func exchange(ctx context.Context, m *dns.Msg, client *client) (r *dns.Msg, rtt time.Duration, err error) {
 	for i := 0; i < maxAttempts; i++ {
-		if client.d.Net == "https" {
-			return exchangeDOH(ctx, m, client.addr)
+		switch client.d.Net {
+		case "https":
+			r, rtt, err = exchangeDOH(ctx, m, client)
+		case "quic":
+			r, rtt, err = exchangeDOQ(ctx, m, client)
+		default:
+			r, rtt, err = client.d.ExchangeContext(ctx, m, client.addr)
 		}
-
-		r, rtt, err = client.d.ExchangeContext(ctx, m, client.addr)
-		if err == nil {
+		if err == nil || ctx.Err() != nil {
 			return
 		}
 	}
@@ -134,101 +216,64 @@ func exchange(ctx context.Context, m *dns.Msg, client *client) (r *dns.Msg, rtt
 	return
 }
 
-func exchangeDOH(ctx context.Context, m *dns.Msg, doh string) (r *dns.Msg, rtt time.Duration, err error) {
-	buf, err := m.Pack()
-	if err != nil {
-		return nil, 0, err
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doh+"/dns-query", bytes.NewReader(buf))
-	if err != nil {
-		return nil, 0, err
-	}
-
-	req.Header.Set("content-type", "application/dns-message")
-	req.Header.Set("accept", "application/dns-message")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, 0, fmt.Errorf("error fetching response %s", resp.Status)
-	}
-
-	defer resp.Body.Close()
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, 0, err
+func (s *Stub) lookup(ctx context.Context, name string, qtype uint16) *DNSResult {
+	e, fresh := s.cached(name, qtype)
+	if fresh {
+		s.cache.count(func(st *CacheStats) { st.Hits++ })
+		s.prefetch(name, qtype, e)
+		return e.result()
 	}
-
-	ans := new(dns.Msg)
-	err = ans.Unpack(b)
-
-	return ans, 0, err
-}
-
-func (s *Stub) checkCache(key string, qtype uint16) (*entry, bool) {
-	if ans, ok := s.rrCache[qtype].get(key); ok {
-		if time.Now().Before(ans.ttl) {
-			return ans, true
-		}
-
-		s.rrCache[qtype].remove(key)
+	s.cache.count(func(st *CacheStats) { st.Misses++ })
+
+	res := s.flight.do(ctx, flightKey(name, qtype), func(ctx context.Context) *DNSResult {
+		return s.resolve(ctx, name, qtype)
+	})
+	if res.Err != nil && e != nil && ctx.Err() == nil {
+		s.cache.count(func(st *CacheStats) { st.Stale++ })
+		return &DNSResult{Records: withTTL(e.msg, staleAnswerTTL), Secure: e.secure, NXDomain: e.nxdomain, Authority: withTTL(e.ns, staleAnswerTTL)}
 	}
-
-	return nil, false
+	return res
 }
 
-func (s *Stub) lookup(ctx context.Context, name string, qtype uint16) *DNSResult {
-	if ans, ok := s.checkCache(name, qtype); ok {
-		return &DNSResult{ans.msg, ans.secure, nil}
-	}
-
+// resolve queries the upstreams for name and caches the answer.
+func (s *Stub) resolve(ctx context.Context, name string, qtype uint16) *DNSResult {
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(name), qtype)
-	m.SetEdns0(4096, false)
+	m.SetEdns0(s.UDPSize, false)
 	m.RecursionDesired = true
 	m.AuthenticatedData = true
 
-	r, _, err := s.exchangeFunc(ctx, m, s.client)
+	r, err := s.query(ctx, m)
 	if err != nil {
-		return &DNSResult{nil, false, err}
-	}
-
-	if s.Verify != nil {
-		if err := s.Verify(r); err != nil {
-			return &DNSResult{nil, false, fmt.Errorf("verify error: %v", err)}
-		}
+		return &DNSResult{Err: err}
 	}
 
 	if r.Truncated {
-		return &DNSResult{nil, false, errors.New("response truncated")}
+		return &DNSResult{Err: errors.New("response truncated")}
 	}
 
 	if r.Rcode == dns.RcodeServerFailure {
-		return &DNSResult{nil, false, ErrServFail}
+		return &DNSResult{Err: ErrServFail}
 	}
 
 	if r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError {
 		e := &entry{
-			msg:    r.Answer,
-			secure: r.AuthenticatedData,
-			ttl:    time.Now().Add(getMinTTL(r)),
+			msg:      r.Answer,
+			ns:       negativeSOA(r),
+			secure:   r.AuthenticatedData,
+			nxdomain: r.Rcode == dns.RcodeNameError,
 		}
+		s.store(name, qtype, e, r)
 
-		s.rrCache[qtype].set(name, e)
-
-		return &DNSResult{e.msg, e.secure, nil}
+		return &DNSResult{Records: e.msg, Secure: e.secure, NXDomain: e.nxdomain, Authority: e.ns}
 	}
 
-	return &DNSResult{nil, false, fmt.Errorf("failed with rcode %d", r.Rcode)}
+	return &DNSResult{Err: fmt.Errorf("failed with rcode %d", r.Rcode)}
 }
 
 // getMinTTL get the ttl for dns msg
 // borrowed from coredns: https://github.com/coredns/coredns/blob/master/plugin/pkg/dnsutil/ttl.go
-func getMinTTL(m *dns.Msg) time.Duration {
+func getMinTTL(m *dns.Msg, maxTTL time.Duration) time.Duration {
 	// No records or OPT is the only record, return a short ttl as a fail safe.
 	if len(m.Answer)+len(m.Ns) == 0 &&
 		(len(m.Extra) == 0 || (len(m.Extra) == 1 && m.Extra[0].Header().Rrtype == dns.TypeOPT)) {
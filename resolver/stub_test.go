@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/miekg/dns"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -44,12 +45,12 @@ func TestStub_NewStub(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if ad.client.addr != "https://cloudflare.com" {
-		t.Fatalf("want %s, got %s", "https://cloudflare.com", ad.client.addr)
+	if ad.clients[0].addr != "https://cloudflare.com" {
+		t.Fatalf("want %s, got %s", "https://cloudflare.com", ad.clients[0].addr)
 	}
 
-	if ad.client.d.Net != "https" {
-		t.Fatalf("want https, got %s", ad.client.d.Net)
+	if ad.clients[0].d.Net != "https" {
+		t.Fatalf("want https, got %s", ad.clients[0].d.Net)
 	}
 
 	ad, err = NewStub("1.1.1.1")
@@ -57,8 +58,8 @@ func TestStub_NewStub(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if ad.client.addr != "1.1.1.1:53" {
-		t.Fatalf("want 1.1.1.1, got %s", ad.client.addr)
+	if ad.clients[0].addr != "1.1.1.1:53" {
+		t.Fatalf("want 1.1.1.1, got %s", ad.clients[0].addr)
 	}
 }
 
@@ -118,3 +119,186 @@ func testRR(rr string) dns.RR {
 
 	return r
 }
+
+func TestStub_Upstreams(t *testing.T) {
+	upstreams := []Upstream{
+		{Addr: "udp://10.0.0.1"},
+		{Addr: "tls://10.0.0.2", Verify: func(m *dns.Msg) error { return errors.New("bad sig") }},
+		{Addr: "tcp://10.0.0.3:5353"},
+		{Addr: "https://doh.example"},
+	}
+	delays := map[string]time.Duration{
+		"10.0.0.3:5353":       20 * time.Millisecond,
+		"https://doh.example": 5 * time.Millisecond,
+	}
+
+	for _, test := range []struct {
+		strategy Strategy
+		want     string
+	}{
+		{StrategyFailover, "10.0.0.3:5353"},
+		{StrategyFastest, "https://doh.example"},
+		{StrategyRace, "https://doh.example"},
+	} {
+		rs, err := NewStubUpstreams(upstreams, test.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mu sync.Mutex
+		var answered string
+		rs.exchangeFunc = func(ctx context.Context, req *dns.Msg, c *client) (*dns.Msg, time.Duration, error) {
+			if c.addr == "10.0.0.1:53" {
+				return nil, 0, errors.New("timeout")
+			}
+			select {
+			case <-time.After(delays[c.addr]):
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+
+			mu.Lock()
+			answered = c.addr
+			mu.Unlock()
+			return testData[req.Question[0].Qtype][req.Question[0].Name], 0, nil
+		}
+
+		ctx := context.Background()
+		// warm up rtt measurements and mark failing upstreams down
+		for i := 0; i < maxFailures+1; i++ {
+			if _, err := rs.query(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); err != nil {
+				t.Fatalf("strategy %d: query(): got %v, want no error", test.strategy, err)
+			}
+		}
+
+		mu.Lock()
+		answered = ""
+		mu.Unlock()
+		if _, _, err := rs.LookupIP(ctx, "ip4", "example.com"); err != nil {
+			t.Fatalf("strategy %d: LookupIP(): got %v, want no error", test.strategy, err)
+		}
+		time.Sleep(30 * time.Millisecond)
+
+		mu.Lock()
+		if answered != test.want {
+			t.Errorf("strategy %d: got answer from %s, want %s", test.strategy, answered, test.want)
+		}
+		mu.Unlock()
+
+		for _, h := range rs.Health() {
+			failing := h.Addr == "10.0.0.1:53" || h.Addr == "10.0.0.2:853"
+			if failing != h.Down {
+				t.Errorf("strategy %d: %s down: got %v, want %v", test.strategy, h.Addr, h.Down, failing)
+			}
+		}
+	}
+
+	if _, err := ParseStrategy("fastest"); err != nil {
+		t.Errorf("ParseStrategy(fastest): got %v, want no error", err)
+	}
+	if _, err := ParseStrategy("slowest"); err == nil {
+		t.Error("ParseStrategy(slowest): got nil, want error")
+	}
+}
+
+func TestStub_Flight(t *testing.T) {
+	rs, _ := NewStub("0.0.0.0")
+	var queries int32
+	release := make(chan struct{})
+	rs.exchangeFunc = func(ctx context.Context, req *dns.Msg, c *client) (*dns.Msg, time.Duration, error) {
+		atomic.AddInt32(&queries, 1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		return &dns.Msg{MsgHdr: testHdrAD, Answer: testRRs(req.Question[0].Name + " 60 IN A 10.0.0.1")}, 0, nil
+	}
+
+	// a waiter giving up doesn't cancel the query for the others
+	cctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan *DNSResult)
+	go func() { cancelled <- rs.lookup(cctx, "example.com", dns.TypeA) }()
+
+	var wg sync.WaitGroup
+	results := make([]*DNSResult, 6)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = rs.lookup(context.Background(), "example.com", dns.TypeA)
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if res := <-cancelled; !errors.Is(res.Err, context.Canceled) {
+		t.Errorf("cancelled lookup: got %v, want %v", res.Err, context.Canceled)
+	}
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&queries); got != 1 {
+		t.Errorf("got %d queries, want 1", got)
+	}
+	for _, res := range results {
+		if res.Err != nil || len(res.Records) != 1 || !res.Secure {
+			t.Errorf("got %+v, want a secure answer", res)
+		}
+	}
+
+	// the query is cancelled once every waiter is gone, a later lookup starts over
+	rs.cache = newCache(maxCache)
+	cctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	blocked := make(chan struct{})
+	rs.exchangeFunc = func(ctx context.Context, req *dns.Msg, c *client) (*dns.Msg, time.Duration, error) {
+		atomic.AddInt32(&queries, 1)
+		select {
+		case <-blocked:
+			return &dns.Msg{MsgHdr: testHdr, Answer: testRRs(req.Question[0].Name + " 60 IN A 10.0.0.1")}, 0, nil
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	if res := rs.lookup(cctx, "example.com", dns.TypeA); !errors.Is(res.Err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", res.Err, context.DeadlineExceeded)
+	}
+	close(blocked)
+	if res := rs.lookup(context.Background(), "example.com", dns.TypeA); res.Err != nil {
+		t.Errorf("got %v, want no error", res.Err)
+	}
+	if got := atomic.LoadInt32(&queries); got != 3 {
+		t.Errorf("got %d queries, want 3", got)
+	}
+}
+
+func TestStub_Truncated(t *testing.T) {
+	rs, _ := NewStub("127.0.0.1")
+	var nets []string
+	rs.exchangeFunc = func(ctx context.Context, req *dns.Msg, c *client) (*dns.Msg, time.Duration, error) {
+		nets = append(nets, c.d.Net)
+		if opt := req.IsEdns0(); opt == nil || opt.UDPSize() != 1232 {
+			t.Errorf("got edns %v, want udp size 1232", opt)
+		}
+		if c.d.Net != "tcp" {
+			return &dns.Msg{MsgHdr: dns.MsgHdr{Truncated: true}}, 0, nil
+		}
+		return &dns.Msg{MsgHdr: testHdrAD, Answer: testRRs("example.com. 60 IN TLSA 3 1 1 " +
+			"0000000000000000000000000000000000000000000000000000000000000000")}, 0, nil
+	}
+	rs.Verify = func(m *dns.Msg) error {
+		if m.Truncated {
+			return errors.New("verifying truncated answer")
+		}
+		return nil
+	}
+
+	res := rs.lookup(context.Background(), "example.com", dns.TypeTLSA)
+	if res.Err != nil || len(res.Records) != 1 {
+		t.Fatalf("got %+v, want the tcp answer", res)
+	}
+	if len(nets) != 2 || nets[1] != "tcp" {
+		t.Errorf("got queries over %q, want udp then tcp", nets)
+	}
+}
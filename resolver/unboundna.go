@@ -19,6 +19,10 @@ func (r *Recursive) ResolvConf(name string) error {
 	return ErrUnboundNotAvail
 }
 
+func (r *Recursive) Config(file string) error {
+	return ErrUnboundNotAvail
+}
+
 func (r *Recursive) AddTA(ta string) error {
 	return ErrUnboundNotAvail
 }
@@ -0,0 +1,241 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategy selects the upstreams a Stub queries.
+type Strategy int
+
+const (
+	// StrategyFailover queries upstreams in order until one answers.
+	StrategyFailover Strategy = iota
+	// StrategyRandom queries upstreams in random order.
+	StrategyRandom
+	// StrategyFastest queries upstreams by their measured round trip time.
+	StrategyFastest
+	// StrategyRace queries all upstreams at once and uses the first answer.
+	StrategyRace
+)
+
+const (
+	// upstreams failing maxFailures times in a row
+	// are skipped for downTime
+	maxFailures = 3
+	downTime    = 30 * time.Second
+	// weight of a new rtt sample
+	rttWeight = 0.3
+)
+
+var errNoUpstreams = errors.New("no upstream servers")
+
+// ParseStrategy parses failover, random, fastest or race.
+func ParseStrategy(s string) (Strategy, error) {
+	switch strings.ToLower(s) {
+	case "", "failover":
+		return StrategyFailover, nil
+	case "random":
+		return StrategyRandom, nil
+	case "fastest":
+		return StrategyFastest, nil
+	case "race":
+		return StrategyRace, nil
+	}
+	return 0, fmt.Errorf("unknown strategy `%s`", s)
+}
+
+// Upstream is a server queried by Stub.
+type Upstream struct {
+	// Addr is a udp://, tcp://, tls://, https:// or quic:// url or host:port. DoH urls
+	// may pin the server key with a #pin-sha256=<base64> fragment.
+	Addr string
+	// Verify if set checks every response of this upstream.
+	Verify func(m *dns.Msg) error
+}
+
+// UpstreamHealth describes the state of an upstream.
+type UpstreamHealth struct {
+	Addr     string
+	RTT      time.Duration
+	Failures int
+	Down     bool
+}
+
+// health tracks the round trip time and failures of an upstream.
+type health struct {
+	mu        sync.Mutex
+	rtt       time.Duration
+	failures  int
+	downUntil time.Time
+}
+
+func (h *health) success(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.rtt == 0 {
+		h.rtt = rtt
+	} else {
+		h.rtt = time.Duration(float64(h.rtt)*(1-rttWeight) + float64(rtt)*rttWeight)
+	}
+	h.failures = 0
+	h.downUntil = time.Time{}
+}
+
+func (h *health) failure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures++
+	if h.failures >= maxFailures {
+		h.downUntil = time.Now().Add(downTime)
+	}
+}
+
+func (h *health) up() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return time.Now().After(h.downUntil)
+}
+
+func (h *health) roundTrip() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.rtt
+}
+
+// Health returns the state of every upstream.
+func (s *Stub) Health() []UpstreamHealth {
+	var hs []UpstreamHealth
+	for _, c := range s.clients {
+		c.health.mu.Lock()
+		hs = append(hs, UpstreamHealth{
+			Addr:     c.addr,
+			RTT:      c.health.rtt,
+			Failures: c.health.failures,
+			Down:     time.Now().Before(c.health.downUntil),
+		})
+		c.health.mu.Unlock()
+	}
+	return hs
+}
+
+// upstreams returns the clients to query in order, healthy ones first.
+func (s *Stub) upstreams() []*client {
+	var up, down []*client
+	for _, c := range s.clients {
+		if c.health.up() {
+			up = append(up, c)
+		} else {
+			down = append(down, c)
+		}
+	}
+
+	switch s.strategy {
+	case StrategyRandom:
+		rand.Shuffle(len(up), func(i, j int) { up[i], up[j] = up[j], up[i] })
+	case StrategyFastest:
+		// upstreams without a sample sort first to get measured
+		sort.SliceStable(up, func(i, j int) bool {
+			return up[i].health.roundTrip() < up[j].health.roundTrip()
+		})
+	}
+
+	return append(up, down...)
+}
+
+// query sends m to the upstreams according to the strategy.
+func (s *Stub) query(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	clients := s.upstreams()
+	if len(clients) == 0 {
+		return nil, errNoUpstreams
+	}
+	if s.strategy == StrategyRace && len(clients) > 1 {
+		return s.race(ctx, m, clients)
+	}
+
+	var err error
+	for _, c := range clients {
+		var r *dns.Msg
+		if r, err = s.try(ctx, m, c); err == nil {
+			return r, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (s *Stub) race(ctx context.Context, m *dns.Msg, clients []*client) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		r   *dns.Msg
+		err error
+	}
+	results := make(chan result, len(clients))
+	for _, c := range clients {
+		go func(c *client) {
+			r, err := s.try(ctx, m.Copy(), c)
+			results <- result{r, err}
+		}(c)
+	}
+
+	var err error
+	for range clients {
+		res := <-results
+		if res.err == nil {
+			return res.r, nil
+		}
+		err = res.err
+	}
+	return nil, err
+}
+
+// try queries a single upstream and records its health.
+func (s *Stub) try(ctx context.Context, m *dns.Msg, c *client) (*dns.Msg, error) {
+	start := time.Now()
+	r, _, err := s.exchangeFunc(ctx, m, c)
+	if err == nil && r.Truncated && c.tcp != nil {
+		r, _, err = s.exchangeFunc(ctx, m, c.tcp)
+	}
+	if err == nil {
+		err = verify(r, c.verify, s.Verify)
+	}
+
+	if err != nil {
+		// a cancelled race says nothing about the upstream
+		if ctx.Err() == nil {
+			c.health.failure()
+		}
+		return nil, err
+	}
+
+	c.health.success(time.Since(start))
+	return r, nil
+}
+
+func verify(r *dns.Msg, fns ...func(m *dns.Msg) error) error {
+	for _, fn := range fns {
+		if fn == nil {
+			continue
+		}
+		if err := fn(r); err != nil {
+			return fmt.Errorf("verify error: %v", err)
+		}
+	}
+	return nil
+}
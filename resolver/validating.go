@@ -0,0 +1,690 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errNoAnchors = errors.New("validating: no trust anchors")
+
+// Validating is a DNSSEC validating resolver
+// implementing the Resolver interface. It fetches records
+// with the CD bit set through a stub resolver, or from the
+// authoritative servers with NewHNSD, and validates them
+// from its trust anchors, without cgo.
+type Validating struct {
+	query   func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	udpSize uint16
+	minTTL  time.Duration
+	maxTTL  time.Duration
+	// validated answers and zone keys
+	cache  *cache
+	flight flight
+
+	mu      sync.RWMutex
+	anchors map[string][]dns.RR
+	// anchorFunc returns the trusted DS records of zone, it reports
+	// false if it has no say over zone
+	anchorFunc func(ctx context.Context, zone string) ([]dns.RR, bool, error)
+
+	DefaultResolver
+}
+
+// NewValidating creates a validating resolver querying
+// the upstreams of stub, trust anchors must be added with
+// AddTA or AddTAFile.
+func NewValidating(stub *Stub) *Validating {
+	v := newValidating(stub.query)
+	v.udpSize = stub.UDPSize
+	v.minTTL = stub.MinTTL
+	v.maxTTL = stub.MaxTTL
+	return v
+}
+
+func newValidating(query func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)) *Validating {
+	v := &Validating{
+		query:   query,
+		udpSize: udpSize,
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+		cache:   newCache(maxCache),
+		anchors: make(map[string][]dns.RR),
+	}
+	v.DefaultResolver = DefaultResolver{
+		Query: v.lookup,
+	}
+
+	return v
+}
+
+// AddTA adds a DS or DNSKEY trust anchor in presentation format.
+func (v *Validating) AddTA(ta string) error {
+	rr, err := dns.NewRR(ta)
+	if err != nil {
+		return fmt.Errorf("validating: bad trust anchor: %v", err)
+	}
+	if rr == nil {
+		return fmt.Errorf("validating: empty trust anchor")
+	}
+	return v.addTA(rr)
+}
+
+// AddTAFile adds the DS and DNSKEY trust anchors of a zone file.
+func (v *Validating) AddTAFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("validating: %v", err)
+	}
+	defer f.Close()
+
+	n := 0
+	zp := dns.NewZoneParser(f, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			if err := v.addTA(rr); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("validating: bad trust anchor file: %v", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("validating: no trust anchors in %s", file)
+	}
+	return nil
+}
+
+func (v *Validating) addTA(rr dns.RR) error {
+	switch rr.(type) {
+	case *dns.DS, *dns.DNSKEY:
+	default:
+		return fmt.Errorf("validating: trust anchor must be a DS or DNSKEY record, got %s",
+			dns.TypeToString[rr.Header().Rrtype])
+	}
+
+	zone := dns.CanonicalName(rr.Header().Name)
+	v.mu.Lock()
+	v.anchors[zone] = append(v.anchors[zone], rr)
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *Validating) anchor(zone string) ([]dns.RR, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if len(v.anchors) == 0 {
+		return nil, false
+	}
+	rrs, ok := v.anchors[zone]
+	return rrs, ok
+}
+
+func (v *Validating) lookup(ctx context.Context, name string, qtype uint16) *DNSResult {
+	v.mu.RLock()
+	n := len(v.anchors)
+	v.mu.RUnlock()
+	if n == 0 && v.anchorFunc == nil {
+		return &DNSResult{Err: errNoAnchors}
+	}
+
+	name = dns.CanonicalName(name)
+	key := flightKey(name, qtype)
+	if e, ok := v.cache.get(key); ok && time.Now().Before(e.ttl) {
+		return e.result()
+	}
+
+	return v.flight.do(ctx, key, func(ctx context.Context) *DNSResult {
+		return v.resolve(ctx, name, qtype)
+	})
+}
+
+func (v *Validating) resolve(ctx context.Context, name string, qtype uint16) *DNSResult {
+	r, err := v.exchange(ctx, name, qtype)
+	if err != nil {
+		return &DNSResult{Err: err}
+	}
+
+	secure, err := v.validate(ctx, name, qtype, r)
+	if err != nil {
+		return &DNSResult{Err: err}
+	}
+
+	var records []dns.RR
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			records = append(records, rr)
+		}
+	}
+	nxdomain := r.Rcode == dns.RcodeNameError
+	soa := negativeSOA(r)
+	v.cache.set(flightKey(name, qtype), &entry{
+		msg:      records,
+		ns:       soa,
+		secure:   secure,
+		nxdomain: nxdomain,
+		ttl:      time.Now().Add(v.ttl(r)),
+	})
+
+	return &DNSResult{Records: records, Secure: secure, NXDomain: nxdomain, Authority: soa}
+}
+
+func (v *Validating) ttl(r *dns.Msg) time.Duration {
+	ttl := getMinTTL(r, v.maxTTL)
+	if ttl < v.minTTL {
+		ttl = v.minTTL
+	}
+	return ttl
+}
+
+// exchange queries the upstreams with the DO and CD bits set.
+func (v *Validating) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(v.udpSize, true)
+	m.RecursionDesired = true
+	m.CheckingDisabled = true
+
+	r, err := v.query(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if r.Truncated {
+		return nil, errors.New("response truncated")
+	}
+
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return r, nil
+	case dns.RcodeServerFailure:
+		return nil, ErrServFail
+	default:
+		return nil, fmt.Errorf("failed with rcode %d", r.Rcode)
+	}
+}
+
+func bogus(format string, args ...interface{}) error {
+	return fmt.Errorf("validating: bogus: %s: %w", fmt.Sprintf(format, args...), ErrBogus)
+}
+
+// validate checks the signatures of the answer to name and qtype,
+// and the denial of existence if there is no answer. It returns
+// whether the answer is secure, or an error wrapping ErrBogus.
+func (v *Validating) validate(ctx context.Context, name string, qtype uint16, r *dns.Msg) (bool, error) {
+	secure := true
+	denials := denialRecords(r.Ns)
+
+	// a cname chain may cross zones, every rrset is validated on its own
+	for _, set := range rrsets(r.Answer) {
+		hdr := set.rrs[0].Header()
+		if c, ok := set.rrs[0].(*dns.CNAME); ok && len(set.sigs) == 0 {
+			if d := dnameFor(r.Answer, hdr.Name); d != nil {
+				if !equalName(c.Target, substitute(hdr.Name, d)) {
+					return false, bogus("cname %s does not match dname %s", hdr.Name, d.Hdr.Name)
+				}
+				continue
+			}
+		}
+
+		ok, sig, err := v.verifySet(ctx, set)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+		if !ok || !wildcardExpanded(sig, hdr.Name) {
+			continue
+		}
+
+		// RFC 4035 section 5.3.4, the name must not exist
+		// for the answer to be synthesized from a wildcard
+		if ok, err = v.verifySets(ctx, denials); err != nil {
+			return false, err
+		}
+		if ok && !coversWildcard(denials, hdr.Name, sig) {
+			return false, bogus("no proof for wildcard answer %s", hdr.Name)
+		}
+	}
+
+	target := name
+	for i := 0; i < 8; i++ {
+		next := ""
+		for _, rr := range r.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && equalName(c.Hdr.Name, target) {
+				next = c.Target
+			}
+		}
+		if next == "" || qtype == dns.TypeCNAME {
+			break
+		}
+		target = next
+	}
+
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == qtype && equalName(rr.Header().Name, target) {
+			return secure, nil
+		}
+	}
+
+	// no answer, the denial of existence must be validated
+	if len(denials) == 0 {
+		_, secure, err := v.zone(ctx, target)
+		if err != nil {
+			return false, err
+		}
+		if secure {
+			return false, bogus("no denial of existence for %s", target)
+		}
+		return false, nil
+	}
+	ok, err := v.verifySets(ctx, denials)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+
+	nxdomain := r.Rcode == dns.RcodeNameError
+	switch deny(denials, target, qtype, nxdomain) {
+	case denialName, denialNoData:
+		return secure, nil
+	case denialOptOut:
+		return false, nil
+	}
+	if nxdomain {
+		return false, bogus("no proof that %s doesn't exist", target)
+	}
+	return false, bogus("no proof that %s has no %s records", target, dns.TypeToString[qtype])
+}
+
+// verifySet validates an rrset with the keys of its signer. It returns
+// false with no error if the signer is below an insecure delegation.
+func (v *Validating) verifySet(ctx context.Context, set rrset) (bool, *dns.RRSIG, error) {
+	hdr := set.rrs[0].Header()
+	if len(set.sigs) == 0 {
+		// only names below an insecure delegation may be unsigned
+		_, secure, err := v.zone(ctx, hdr.Name)
+		if err != nil {
+			return false, nil, err
+		}
+		if secure {
+			return false, nil, bogus("no signature for %s %s", hdr.Name, dns.TypeToString[hdr.Rrtype])
+		}
+		return false, nil, nil
+	}
+
+	signer := set.sigs[0].SignerName
+	if !dns.IsSubDomain(signer, hdr.Name) {
+		return false, nil, bogus("%s %s is signed by %s", hdr.Name, dns.TypeToString[hdr.Rrtype], signer)
+	}
+	keys, secure, err := v.zone(ctx, signer)
+	if err != nil || !secure {
+		return false, nil, err
+	}
+
+	sig, err := verifyWith(set, keys)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, sig, nil
+}
+
+// verifySets validates every rrset of rrs.
+func (v *Validating) verifySets(ctx context.Context, rrs []dns.RR) (bool, error) {
+	secure := true
+	for _, set := range rrsets(rrs) {
+		ok, _, err := v.verifySet(ctx, set)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+	}
+	return secure, nil
+}
+
+// zone returns the validated keys of the closest zone enclosing name and
+// whether it is secure, insecure zones are below a delegation without DS
+// or outside of the trust anchors.
+func (v *Validating) zone(ctx context.Context, name string) ([]*dns.DNSKEY, bool, error) {
+	name = dns.CanonicalName(name)
+	key := "zone/" + name
+	if e, ok := v.cache.get(key); ok && time.Now().Before(e.ttl) {
+		return dnskeys(e.msg), e.secure, nil
+	}
+
+	res := v.flight.do(ctx, key, func(ctx context.Context) *DNSResult {
+		keys, secure, ttl, err := v.fetchZone(ctx, name)
+		if err != nil {
+			return &DNSResult{Err: err}
+		}
+
+		var rrs []dns.RR
+		for _, k := range keys {
+			rrs = append(rrs, k)
+		}
+		v.cache.set(key, &entry{msg: rrs, secure: secure, ttl: time.Now().Add(ttl)})
+		return &DNSResult{Records: rrs, Secure: secure}
+	})
+	if res.Err != nil {
+		return nil, false, res.Err
+	}
+	return dnskeys(res.Records), res.Secure, nil
+}
+
+func (v *Validating) fetchZone(ctx context.Context, name string) ([]*dns.DNSKEY, bool, time.Duration, error) {
+	if anchors, ok := v.anchor(name); ok {
+		return v.fetchKeys(ctx, name, anchors)
+	}
+	if v.anchorFunc != nil {
+		anchors, ok, err := v.anchorFunc(ctx, name)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		if ok && len(anchors) == 0 {
+			return nil, false, v.maxTTL, nil
+		}
+		if ok {
+			return v.fetchKeys(ctx, name, anchors)
+		}
+	}
+	if name == "." {
+		// outside of the trust anchors
+		return nil, false, v.maxTTL, nil
+	}
+
+	r, err := v.exchange(ctx, name, dns.TypeDS)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	parent := suffix(name, dns.CountLabel(name)-1)
+
+	sets := rrsets(r.Answer)
+	var ds rrset
+	for _, set := range sets {
+		if set.rrs[0].Header().Rrtype == dns.TypeDS && equalName(set.rrs[0].Header().Name, name) {
+			ds = set
+		}
+	}
+
+	section := r.Answer
+	if ds.rrs == nil {
+		section = denialRecords(r.Ns)
+	}
+	signer := ""
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			signer = sig.SignerName
+			break
+		}
+	}
+
+	if signer == "" {
+		// an unsigned answer is only fine below an insecure delegation
+		keys, secure, err := v.zone(ctx, parent)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		if secure {
+			return nil, false, 0, bogus("no signature for the DS of %s", name)
+		}
+		return keys, false, v.ttl(r), nil
+	}
+	if equalName(signer, name) || !dns.IsSubDomain(signer, name) {
+		return nil, false, 0, bogus("DS of %s is signed by %s", name, signer)
+	}
+
+	keys, secure, err := v.zone(ctx, signer)
+	if err != nil || !secure {
+		return keys, false, v.ttl(r), err
+	}
+	for _, set := range rrsets(section) {
+		if _, err := verifyWith(set, keys); err != nil {
+			return nil, false, 0, err
+		}
+	}
+
+	if ds.rrs != nil {
+		return v.fetchKeys(ctx, name, ds.rrs)
+	}
+
+	if r.Rcode == dns.RcodeNameError {
+		if deny(section, name, dns.TypeDS, true) != denialName {
+			return nil, false, 0, bogus("no proof that %s doesn't exist", name)
+		}
+		return keys, true, v.ttl(r), nil
+	}
+
+	if types, ok := bitmap(section, name); ok {
+		switch {
+		case hasType(types, dns.TypeDS):
+			return nil, false, 0, bogus("DS of %s denied by a record listing it", name)
+		case hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA):
+			// a delegation without DS
+			return nil, false, v.ttl(r), nil
+		}
+		// not a zone cut, the name belongs to the signer's zone
+		return keys, true, v.ttl(r), nil
+	}
+
+	switch deny(section, name, dns.TypeDS, false) {
+	case denialOptOut:
+		return nil, false, v.ttl(r), nil
+	case denialNoData:
+		return keys, true, v.ttl(r), nil
+	}
+	return nil, false, 0, bogus("no proof that %s has no DS records", name)
+}
+
+// fetchKeys fetches the DNSKEY rrset of zone and validates it with
+// one of the keys matching a trusted DS or DNSKEY record.
+func (v *Validating) fetchKeys(ctx context.Context, zone string, trusted []dns.RR) ([]*dns.DNSKEY, bool, time.Duration, error) {
+	supported := false
+	for _, rr := range trusted {
+		switch t := rr.(type) {
+		case *dns.DS:
+			supported = supported || (supportedAlgorithms[t.Algorithm] && supportedDigests[t.DigestType])
+		case *dns.DNSKEY:
+			supported = supported || supportedAlgorithms[t.Algorithm]
+		}
+	}
+	if !supported {
+		// RFC 4035 section 5.2, treated as insecure
+		return nil, false, v.maxTTL, nil
+	}
+
+	r, err := v.exchange(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	var set rrset
+	for _, s := range rrsets(r.Answer) {
+		if s.rrs[0].Header().Rrtype == dns.TypeDNSKEY && equalName(s.rrs[0].Header().Name, zone) {
+			set = s
+		}
+	}
+	keys := dnskeys(set.rrs)
+	if len(keys) == 0 {
+		return nil, false, 0, bogus("no DNSKEY records for %s", zone)
+	}
+
+	var secureEntry []*dns.DNSKEY
+	for _, k := range keys {
+		if trustedKey(k, trusted) {
+			secureEntry = append(secureEntry, k)
+		}
+	}
+	if len(secureEntry) == 0 {
+		return nil, false, 0, bogus("no DNSKEY of %s matches its DS", zone)
+	}
+	if _, err := verifyWith(set, secureEntry); err != nil {
+		return nil, false, 0, err
+	}
+
+	return keys, true, v.ttl(r), nil
+}
+
+func trustedKey(k *dns.DNSKEY, trusted []dns.RR) bool {
+	for _, rr := range trusted {
+		switch t := rr.(type) {
+		case *dns.DS:
+			if k.KeyTag() != t.KeyTag || k.Algorithm != t.Algorithm {
+				continue
+			}
+			if ds := k.ToDS(t.DigestType); ds != nil && strings.EqualFold(ds.Digest, t.Digest) {
+				return true
+			}
+		case *dns.DNSKEY:
+			if k.Algorithm == t.Algorithm && k.PublicKey == t.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyWith validates set with one of keys, it returns the valid signature.
+func verifyWith(set rrset, keys []*dns.DNSKEY) (*dns.RRSIG, error) {
+	hdr := set.rrs[0].Header()
+	now := time.Now()
+	expired := false
+	for _, sig := range set.sigs {
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm ||
+				k.Flags&dns.ZONE == 0 || !equalName(k.Hdr.Name, sig.SignerName) {
+				continue
+			}
+			if err := sig.Verify(k, set.rrs); err != nil {
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				expired = true
+				continue
+			}
+			return sig, nil
+		}
+	}
+
+	if expired {
+		return nil, bogus("signature of %s %s is expired or not yet valid", hdr.Name, dns.TypeToString[hdr.Rrtype])
+	}
+	return nil, bogus("no valid signature for %s %s", hdr.Name, dns.TypeToString[hdr.Rrtype])
+}
+
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// rrsets groups records by name and type with their signatures.
+func rrsets(rrs []dns.RR) []rrset {
+	var sets []rrset
+	index := make(map[string]int)
+	key := func(name string, t uint16) string {
+		return dns.CanonicalName(name) + "/" + dns.TypeToString[t]
+	}
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		k := key(rr.Header().Name, rr.Header().Rrtype)
+		i, ok := index[k]
+		if !ok {
+			i = len(sets)
+			index[k] = i
+			sets = append(sets, rrset{})
+		}
+		sets[i].rrs = append(sets[i].rrs, rr)
+	}
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		if i, ok := index[key(sig.Hdr.Name, sig.TypeCovered)]; ok {
+			sets[i].sigs = append(sets[i].sigs, sig)
+		}
+	}
+	return sets
+}
+
+// denialRecords returns the records of ns proving a denial of existence.
+func denialRecords(ns []dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range ns {
+		t := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+		switch t {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+func dnskeys(rrs []dns.RR) []*dns.DNSKEY {
+	var keys []*dns.DNSKEY
+	for _, rr := range rrs {
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// dnameFor returns the DNAME an unsigned cname at name may have been
+// synthesized from, the cname is validated through the DNAME signature.
+func dnameFor(answer []dns.RR, name string) *dns.DNAME {
+	for _, rr := range answer {
+		if d, ok := rr.(*dns.DNAME); ok && dns.IsSubDomain(d.Hdr.Name, name) && !equalName(d.Hdr.Name, name) {
+			return d
+		}
+	}
+	return nil
+}
+
+// substitute returns the target d synthesizes for name (RFC 6672 section 2.2).
+func substitute(name string, d *dns.DNAME) string {
+	labels := dns.SplitDomainName(name)
+	prefix := labels[:len(labels)-dns.CountLabel(d.Hdr.Name)]
+	return dns.Fqdn(strings.Join(prefix, ".") + "." + strings.TrimSuffix(dns.Fqdn(d.Target), "."))
+}
+
+// wildcardExpanded tells whether sig signs an answer synthesized from a wildcard.
+func wildcardExpanded(sig *dns.RRSIG, name string) bool {
+	if sig == nil || strings.HasPrefix(name, "*.") {
+		return false
+	}
+	return int(sig.Labels) < dns.CountLabel(name)
+}
+
+// coversWildcard tells whether denials prove the name an answer was
+// expanded for doesn't exist.
+func coversWildcard(denials []dns.RR, name string, sig *dns.RRSIG) bool {
+	nc := suffix(name, int(sig.Labels)+1)
+	for _, rr := range denials {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(t, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if t.Cover(nc) {
+				return true
+			}
+		}
+	}
+	return false
+}
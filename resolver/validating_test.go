@@ -0,0 +1,219 @@
+package resolver
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := k.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{k, priv.(crypto.Signer)}
+}
+
+// sign returns rrs followed by their signature.
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	now := time.Now()
+	sig := &dns.RRSIG{
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func TestValidating(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	ds := example.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+
+	soa := testRR("example. 300 IN SOA ns.example. admin.example. 1 7200 3600 1209600 300")
+	rootSOA := testRR(". 300 IN SOA a.root. admin.root. 1 7200 3600 1209600 300")
+	nsec := func(owner, next string, types ...uint16) dns.RR {
+		return &dns.NSEC{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: next, TypeBitMap: types}
+	}
+	tampered := testRR("tampered.example. 60 IN A 10.0.0.2")
+	signed := example.sign(t, testRR("tampered.example. 60 IN A 10.0.0.1"))
+	signed[0] = tampered
+
+	dname := example.sign(t, testRR("dname.example. 60 IN DNAME www.example."))
+	target := example.sign(t, testRR("www.example. 60 IN A 10.0.0.1"))
+
+	responses := map[string]*dns.Msg{
+		"a.dname.example./A": {Answer: append(append(dname,
+			testRR("a.dname.example. 60 IN CNAME a.www.example.")), example.sign(t, testRR("a.www.example. 60 IN A 10.0.0.1"))...)},
+		"b.dname.example./A": {Answer: append(append(dname,
+			testRR("b.dname.example. 60 IN CNAME www.example.")), target...)},
+		"./DNSKEY":            {Answer: root.sign(t, root.key)},
+		"example./DS":         {Answer: root.sign(t, ds)},
+		"example./DNSKEY":     {Answer: example.sign(t, example.key)},
+		"www.example./A":      {Answer: example.sign(t, testRR("www.example. 60 IN A 10.0.0.1"))},
+		"tampered.example./A": {Answer: signed},
+		"unsigned.example./A": {Answer: testRRs("unsigned.example. 60 IN A 10.0.0.1")},
+		"unsigned.example./DS": {Ns: append(example.sign(t, soa),
+			example.sign(t, nsec("unsigned.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))...)},
+		"nx.example./A": {MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: append(append(example.sign(t, soa),
+			example.sign(t, nsec("example.", "unsigned.example.", dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY))...),
+			example.sign(t, nsec("www.example.", "example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))...)},
+		"www.example./AAAA": {Ns: append(example.sign(t, soa),
+			example.sign(t, nsec("www.example.", "example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))...)},
+		"insecure./DS": {Ns: append(root.sign(t, rootSOA),
+			root.sign(t, nsec("insecure.", "example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))...)},
+		"www.insecure./DS": {Ns: testRRs("insecure. 300 IN SOA ns.insecure. admin.insecure. 1 7200 3600 1209600 300")},
+		"www.insecure./A":  {Answer: testRRs("www.insecure. 60 IN A 10.0.0.3")},
+	}
+
+	rs, _ := NewStub("0.0.0.0")
+	rs.exchangeFunc = func(ctx context.Context, req *dns.Msg, c *client) (*dns.Msg, time.Duration, error) {
+		q := req.Question[0]
+		if opt := req.IsEdns0(); !req.CheckingDisabled || opt == nil || !opt.Do() {
+			t.Errorf("%s: want the CD and DO bits set", q.Name)
+		}
+		r, ok := responses[q.Name+"/"+dns.TypeToString[q.Qtype]]
+		if !ok {
+			return nil, 0, errors.New("unexpected query " + q.Name + " " + dns.TypeToString[q.Qtype])
+		}
+		return r.Copy(), 0, nil
+	}
+
+	v := NewValidating(rs)
+	if res := v.lookup(context.Background(), "www.example", dns.TypeA); !errors.Is(res.Err, errNoAnchors) {
+		t.Fatalf("got %v, want %v", res.Err, errNoAnchors)
+	}
+	rootDS := root.key.ToDS(dns.SHA256)
+	if err := v.AddTA(rootDS.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		records int
+		secure  bool
+		bogus   bool
+	}{
+		{"www.example", dns.TypeA, 1, true, false},
+		{"www.example", dns.TypeAAAA, 0, true, false},
+		{"nx.example", dns.TypeA, 0, true, false},
+		{"tampered.example", dns.TypeA, 0, false, true},
+		{"unsigned.example", dns.TypeA, 0, false, true},
+		{"www.insecure", dns.TypeA, 1, false, false},
+		{"a.dname.example", dns.TypeA, 3, true, false},
+		{"b.dname.example", dns.TypeA, 0, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			res := v.lookup(context.Background(), tt.name, tt.qtype)
+			if tt.bogus {
+				if !errors.Is(res.Err, ErrBogus) {
+					t.Fatalf("got %v, want %v", res.Err, ErrBogus)
+				}
+				return
+			}
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			if len(res.Records) != tt.records {
+				t.Errorf("got %d records, want %d", len(res.Records), tt.records)
+			}
+			if res.Secure != tt.secure {
+				t.Errorf("got secure %v, want %v", res.Secure, tt.secure)
+			}
+		})
+	}
+
+	// a wrong anchor makes everything bogus
+	other := NewValidating(rs)
+	bad := newTestZone(t, ".").key.ToDS(dns.SHA256)
+	f := filepath.Join(t.TempDir(), "root.key")
+	if err := os.WriteFile(f, []byte(bad.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AddTAFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if res := other.lookup(context.Background(), "www.example", dns.TypeA); !errors.Is(res.Err, ErrBogus) {
+		t.Errorf("got %v, want %v", res.Err, ErrBogus)
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// RFC 4034 section 6.1
+	names := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "\\001.z.example.", "*.z.example.", "\\200.z.example."}
+	for i := 0; i < len(names)-1; i++ {
+		if got := canonicalCompare(names[i], names[i+1]); got >= 0 {
+			t.Errorf("%s, %s: got %d, want < 0", names[i], names[i+1], got)
+		}
+	}
+}
+
+func TestDenyNSEC3(t *testing.T) {
+	names := []string{"example.", "www.example."}
+	hashes := make([]string, len(names))
+	for i, n := range names {
+		hashes[i] = dns.HashName(n, dns.SHA1, 0, "")
+	}
+	var ns []dns.RR
+	for i, n := range names {
+		types := []uint16{dns.TypeA, dns.TypeRRSIG}
+		if n == "example." {
+			types = []uint16{dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY}
+		}
+		ns = append(ns, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: hashes[i] + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      1,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: types,
+		})
+	}
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		nxdomain bool
+		want     denial
+	}{
+		{"www.example.", dns.TypeAAAA, false, denialNoData},
+		{"www.example.", dns.TypeA, false, denialNone},
+		{"nx.example.", dns.TypeA, true, denialName},
+		{"www.example.", dns.TypeA, true, denialNone},
+		{"sub.example.", dns.TypeDS, false, denialOptOut},
+	}
+	for _, tt := range tests {
+		if got := deny(ns, tt.name, tt.qtype, tt.nxdomain); got != tt.want {
+			t.Errorf("%s %s: got %v, want %v", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Policy checks a certificate before it is signed.
+type Policy func(cert *x509.Certificate) error
+
+// PermitDomains returns a policy allowing certificates only for names
+// equal to or below one of the given domains.
+func PermitDomains(domains []string) Policy {
+	return func(cert *x509.Certificate) error {
+		if len(cert.IPAddresses) > 0 {
+			return errors.New("ip addresses are not permitted")
+		}
+
+		for _, name := range cert.DNSNames {
+			if !permitted(domains, name) {
+				return fmt.Errorf("name %s is not permitted", name)
+			}
+		}
+		return nil
+	}
+}
+
+func permitted(domains []string, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, d := range domains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Server signs certificates for clients on a unix socket.
+type Server struct {
+	Signer crypto.Signer
+	// Issuer if set must match the issuer of signed certificates.
+	Issuer *x509.Certificate
+	// Policy if set is checked before signing a certificate,
+	// CA certificates are never signed.
+	Policy Policy
+	// AllowDigest permits signing arbitrary digests which bypasses the policy.
+	AllowDigest bool
+}
+
+// ListenAndServe listens on the unix socket path and serves requests.
+func (s *Server) ListenAndServe(socket string) error {
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves one request on each.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var req request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	var resp response
+	data, err := s.handle(&req)
+	if err != nil {
+		log.Printf("[WARN] signer: %s: %v", req.Op, err)
+		resp.Error = err.Error()
+	}
+	resp.Data = data
+
+	json.NewEncoder(conn).Encode(&resp)
+}
+
+func (s *Server) handle(req *request) ([]byte, error) {
+	switch req.Op {
+	case opPublic:
+		return x509.MarshalPKIXPublicKey(s.Signer.Public())
+	case opSignDigest:
+		if !s.AllowDigest {
+			return nil, errors.New("signing digests is not allowed")
+		}
+		var opts crypto.SignerOpts = req.Hash
+		if req.PSS {
+			opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: req.Hash}
+		}
+		return s.Signer.Sign(rand.Reader, req.Data, opts)
+	case opSignCertificate:
+		return s.signCertificate(req.Data)
+	}
+
+	return nil, fmt.Errorf("unknown op `%s`", req.Op)
+}
+
+func (s *Server) signCertificate(tbs []byte) ([]byte, error) {
+	var cert certificate
+	if _, err := asn1.Unmarshal(tbs, &cert.TBSCertificate); err != nil {
+		return nil, err
+	}
+	// parse the tbs certificate with an empty signature
+	// to check it against the policy
+	var tbsAlg struct {
+		Version      int `asn1:"optional,explicit,default:0,tag:0"`
+		SerialNumber asn1.RawValue
+		Algorithm    asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(tbs, &tbsAlg); err != nil {
+		return nil, err
+	}
+	if _, err := asn1.Unmarshal(tbsAlg.Algorithm.FullBytes, &cert.SignatureAlgorithm); err != nil {
+		return nil, err
+	}
+
+	raw, err := asn1.Marshal(cert)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.IsCA {
+		return nil, errors.New("ca certificates are not signed")
+	}
+	if s.Issuer != nil && string(parsed.RawIssuer) != string(s.Issuer.RawSubject) {
+		return nil, errors.New("issuer does not match")
+	}
+	if s.Policy != nil {
+		if err := s.Policy(parsed); err != nil {
+			return nil, err
+		}
+	}
+
+	opts, err := signerOpts(parsed.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := tbs
+	if h := opts.HashFunc(); h != 0 {
+		hh := h.New()
+		hh.Write(tbs)
+		msg = hh.Sum(nil)
+	}
+
+	log.Printf("[INFO] signer: signing certificate for %v", parsed.DNSNames)
+	return s.Signer.Sign(rand.Reader, msg, opts)
+}
+
+func signerOpts(alg x509.SignatureAlgorithm) (crypto.SignerOpts, error) {
+	switch alg {
+	case x509.SHA256WithRSA, x509.ECDSAWithSHA256:
+		return crypto.SHA256, nil
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		return crypto.SHA384, nil
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		return crypto.SHA512, nil
+	case x509.SHA256WithRSAPSS:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}, nil
+	case x509.SHA384WithRSAPSS:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA384}, nil
+	case x509.SHA512WithRSAPSS:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA512}, nil
+	case x509.PureEd25519:
+		return crypto.Hash(0), nil
+	}
+	return nil, fmt.Errorf("unsupported signature algorithm %v", alg)
+}
@@ -0,0 +1,180 @@
+// Package signer keeps the CA private key in a separate process. The proxy
+// talks to the signer over a unix socket using one json request and response
+// per connection.
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	opPublic = "public"
+	// opSignCertificate signs a tbs certificate, the signer checks
+	// the certificate against its policy before signing.
+	opSignCertificate = "sign-certificate"
+	// opSignDigest signs an arbitrary digest, only allowed if the
+	// signer has no policy.
+	opSignDigest = "sign-digest"
+)
+
+const timeout = 10 * time.Second
+
+type request struct {
+	Op   string `json:"op"`
+	Data []byte `json:"data,omitempty"`
+	// Hash and PSS are the signer options for opSignDigest.
+	Hash crypto.Hash `json:"hash,omitempty"`
+	PSS  bool        `json:"pss,omitempty"`
+}
+
+type response struct {
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// certificate is the asn1 structure of an x509 certificate
+type certificate struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+// Client is a crypto.Signer backed by a signer process.
+type Client struct {
+	socket string
+	pub    crypto.PublicKey
+
+	// draft signs certificates locally to produce the tbs
+	// certificate sent to the signer.
+	draftOnce sync.Once
+	draft     crypto.Signer
+	draftErr  error
+}
+
+// Dial connects to the signer listening on socket and fetches its public key.
+func Dial(socket string) (*Client, error) {
+	c := &Client{socket: socket}
+
+	b, err := c.do(&request{Op: opPublic})
+	if err != nil {
+		return nil, err
+	}
+	if c.pub, err = x509.ParsePKIXPublicKey(b); err != nil {
+		return nil, fmt.Errorf("signer: bad public key: %v", err)
+	}
+
+	return c, nil
+}
+
+func (c *Client) do(req *request) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", c.socket, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("signer: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("signer: %v", err)
+	}
+
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("signer: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("signer: %s", resp.Error)
+	}
+	return resp.Data, nil
+}
+
+// Public returns the public key of the signer.
+func (c *Client) Public() crypto.PublicKey {
+	return c.pub
+}
+
+// Sign signs digest with the signer key. Signers enforcing a naming
+// policy refuse this, use CreateCertificate instead.
+func (c *Client) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	_, pss := opts.(*rsa.PSSOptions)
+	return c.do(&request{
+		Op:   opSignDigest,
+		Data: digest,
+		Hash: opts.HashFunc(),
+		PSS:  pss,
+	})
+}
+
+// CreateCertificate creates a certificate like x509.CreateCertificate, the
+// whole tbs certificate is sent to the signer so that it can check the names
+// it vouches for.
+func (c *Client) CreateCertificate(template, parent *x509.Certificate, pub interface{}) ([]byte, error) {
+	c.draftOnce.Do(func() {
+		c.draft, c.draftErr = newDraftKey(c.pub)
+	})
+	if c.draftErr != nil {
+		return nil, c.draftErr
+	}
+
+	// the draft key stands in for the signer key, the tbs certificate
+	// does not depend on the issuer key apart from its algorithm.
+	draftParent := *parent
+	draftParent.PublicKey = c.draft.Public()
+	raw, err := x509.CreateCertificate(rand.Reader, template, &draftParent, pub, c.draft)
+	if err != nil {
+		return nil, err
+	}
+
+	var cert certificate
+	if _, err := asn1.Unmarshal(raw, &cert); err != nil {
+		return nil, err
+	}
+
+	sig, err := c.do(&request{Op: opSignCertificate, Data: cert.TBSCertificate.FullBytes})
+	if err != nil {
+		return nil, err
+	}
+	cert.SignatureValue = asn1.BitString{Bytes: sig, BitLength: len(sig) * 8}
+
+	raw, err = asn1.Marshal(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := signed.CheckSignatureFrom(parent); err != nil {
+		return nil, fmt.Errorf("signer: bad signature: %v", err)
+	}
+	return raw, nil
+}
+
+// newDraftKey generates a key of the same type as pub.
+func newDraftKey(pub crypto.PublicKey) (crypto.Signer, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.GenerateKey(rand.Reader, k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return ecdsa.GenerateKey(k.Curve, rand.Reader)
+	case ed25519.PublicKey:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, errors.New("signer: unsupported key type")
+}
@@ -0,0 +1,139 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T, priv crypto.Signer) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "TEST CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(raw)
+	return ca
+}
+
+func startTestServer(t *testing.T, s *Server) string {
+	socket := filepath.Join(t.TempDir(), "signer.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go s.Serve(l)
+	return socket
+}
+
+func leafTemplate(names ...string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+}
+
+func TestSigner(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		ca := newTestCA(t, key)
+		socket := startTestServer(t, &Server{
+			Signer: key,
+			Issuer: ca,
+			Policy: PermitDomains([]string{"htools", "lazydane."}),
+		})
+
+		c, err := Dial(socket)
+		if err != nil {
+			t.Fatalf("Dial(): got %v, want no error", err)
+		}
+
+		raw, err := c.CreateCertificate(leafTemplate("test.lazydane"), ca, leafKey.Public())
+		if err != nil {
+			t.Fatalf("CreateCertificate(test.lazydane): got %v, want no error", err)
+		}
+
+		leaf, err := x509.ParseCertificate(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "test.lazydane", Roots: roots}); err != nil {
+			t.Errorf("Verify(): got %v, want no error", err)
+		}
+
+		if _, err := c.CreateCertificate(leafTemplate("example.com"), ca, leafKey.Public()); err == nil {
+			t.Error("CreateCertificate(example.com): got nil, want error")
+		}
+		if _, err := c.CreateCertificate(leafTemplate("htools", "example.com"), ca, leafKey.Public()); err == nil {
+			t.Error("CreateCertificate(htools, example.com): got nil, want error")
+		}
+
+		caTmpl := leafTemplate("htools")
+		caTmpl.IsCA = true
+		caTmpl.BasicConstraintsValid = true
+		if _, err := c.CreateCertificate(caTmpl, ca, leafKey.Public()); err == nil {
+			t.Error("CreateCertificate(ca): got nil, want error")
+		}
+
+		digest := sha256.Sum256([]byte("foo"))
+		if _, err := c.Sign(rand.Reader, digest[:], crypto.SHA256); err == nil {
+			t.Error("Sign(): got nil, want error")
+		}
+	}
+}
+
+func TestSignerDigest(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	socket := startTestServer(t, &Server{Signer: key, AllowDigest: true})
+
+	c, err := Dial(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("foo"))
+	sig, err := c.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign(): got %v, want no error", err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], sig) {
+		t.Error("Sign(): got an invalid signature")
+	}
+
+	// a signer without a policy works with x509.CreateCertificate as well
+	ca := newTestCA(t, key)
+	if _, err := x509.CreateCertificate(rand.Reader, leafTemplate("htools"), ca, key.Public(), c); err != nil {
+		t.Errorf("x509.CreateCertificate(): got %v, want no error", err)
+	}
+}
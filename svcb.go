@@ -0,0 +1,142 @@
+package sane
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxAliases bounds the HTTPS alias mode records followed.
+const maxAliases = 8
+
+// endpoint is an alternative endpoint of a service from an HTTPS record.
+type endpoint struct {
+	port string
+	ips  []net.IP
+	// alpn are the protocols supported by the endpoint
+	alpn []string
+	// ech is the ECHConfigList of the endpoint, set only
+	// for DNSSEC secure records.
+	ech []byte
+}
+
+// protos returns the client protocols supported by the endpoint
+// in the client's order of preference.
+func (e *endpoint) protos(client []string) []string {
+	var protos []string
+	for _, p := range client {
+		if slices.Contains(e.alpn, p) {
+			protos = append(protos, p)
+		}
+	}
+	return protos
+}
+
+// httpsName returns the name of the HTTPS records for host and port (RFC 9460 section 9.1).
+func httpsName(host, port string) string {
+	if port == "443" || port == "" {
+		return dns.Fqdn(host)
+	}
+	return "_" + port + "._https." + dns.Fqdn(host)
+}
+
+// lookupHTTPS looks up the service mode HTTPS records of host following alias mode
+// records, it returns them sorted by priority and whether all lookups were secure.
+// Lookup errors are ignored, the origin is used instead.
+func (d *dialer) lookupHTTPS(ctx context.Context, host, port string) ([]*dns.HTTPS, bool) {
+	name := httpsName(host, port)
+	secure := true
+	for i := 0; i < maxAliases; i++ {
+		rrs, ok, err := d.resolver.LookupHTTPS(ctx, name)
+		if err != nil || len(rrs) == 0 {
+			return nil, false
+		}
+		secure = secure && ok
+
+		var service []*dns.HTTPS
+		alias := ""
+		for _, rr := range rrs {
+			if rr.Priority == 0 {
+				alias = rr.Target
+				continue
+			}
+			service = append(service, rr)
+		}
+		// service mode records take precedence (RFC 9460 section 2.4.1)
+		if len(service) > 0 || alias == "" || alias == "." {
+			slices.SortStableFunc(service, func(a, b *dns.HTTPS) int {
+				return int(a.Priority) - int(b.Priority)
+			})
+			return service, secure
+		}
+		name = alias
+	}
+	return nil, false
+}
+
+// endpoints returns the endpoints of the HTTPS records of dst.
+func (d *dialer) endpoints(ctx context.Context, dst *addrList) []*endpoint {
+	var endpoints []*endpoint
+	for _, rr := range dst.HTTPS {
+		e := &endpoint{port: dst.Port}
+		noDefaultALPN := false
+		var hints []net.IP
+		for _, kv := range rr.Value {
+			switch t := kv.(type) {
+			case *dns.SVCBPort:
+				e.port = strconv.Itoa(int(t.Port))
+			case *dns.SVCBAlpn:
+				e.alpn = append(e.alpn, t.Alpn...)
+			case *dns.SVCBNoDefaultAlpn:
+				noDefaultALPN = true
+			case *dns.SVCBIPv4Hint:
+				hints = append(hints, t.Hint...)
+			case *dns.SVCBIPv6Hint:
+				hints = append(hints, t.Hint...)
+			case *dns.SVCBECHConfig:
+				if dst.HTTPSSecure {
+					e.ech = t.ECH
+				}
+			}
+		}
+		if len(e.alpn) > 0 && !noDefaultALPN {
+			e.alpn = append(e.alpn, "http/1.1")
+		}
+
+		// the target of "." is the owner name without the port prefix
+		target := rr.Target
+		if target == "." {
+			target = trimPrefixLabels(rr.Hdr.Name)
+		}
+		if strings.EqualFold(dns.Fqdn(target), dns.Fqdn(dst.Host)) {
+			e.ips = dst.IPs
+		} else {
+			e.ips, _, _ = d.resolver.LookupIP(ctx, "ip", target)
+		}
+		// hints are only used when the addresses of the target are unknown
+		if len(e.ips) == 0 {
+			e.ips = hints
+		}
+		if len(e.ips) == 0 {
+			continue
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
+// trimPrefixLabels removes the leading underscore labels of name.
+func trimPrefixLabels(name string) string {
+	for strings.HasPrefix(name, "_") {
+		i := strings.Index(name, ".")
+		if i == -1 {
+			return name
+		}
+		name = name[i+1:]
+	}
+	return name
+}
@@ -29,10 +29,12 @@ func contains(s []BlockInfo, str string) bool {
 }
 
 const (
-	BlocksToStore  = 40
-	dnsServer      = "127.0.0.1"
-	dnsPort        = "5350"
-	dnsAddress     = dnsServer + ":" + dnsPort
+	BlocksToStore = 40
+	dnsServer     = "127.0.0.1"
+	dnsPort       = "5350"
+	dnsAddress    = dnsServer + ":" + dnsPort
+	// RootServer is the address of the hnsd root server
+	RootServer     = dnsAddress
 	qtype          = "TXT"
 	qclass         = "HS"
 	qname          = "synced.chain.hnsd"
@@ -97,7 +99,7 @@ func checkIfSynced() (bool, error) {
 	return false, nil
 }
 
-func GetRoots(ctx context.Context, pathToExecutable string, confPath string, pathToCheckpoint string) {
+func prepareDirs(confPath string, pathToCheckpoint string) (string, string) {
 	if pathToCheckpoint == "" {
 		home, _ := os.UserHomeDir() //above already fails if it doesn't exist
 		pathToCheckpoint = path.Join(home, ".hnsd")
@@ -115,9 +117,31 @@ func GetRoots(ctx context.Context, pathToExecutable string, confPath string, pat
 	} else if err != nil {
 		log.Fatal(err)
 	}
+	return rootPath, pathToCheckpoint
+}
+
+func hnsdCommand(ctx context.Context, pathToExecutable string, pathToCheckpoint string) *exec.Cmd {
+	return exec.CommandContext(ctx, pathToExecutable, "-n", dnsAddress, "-p", "4", "-r", "127.0.0.1:12345", "-t", "-x", pathToCheckpoint)
+}
+
+// waitHNSD waits for hnsd to answer on its root server.
+func waitHNSD() error {
+	time.Sleep(100 * time.Millisecond) //0.1 second should suffice for the most of the computers
+	var err error
+	for i := 1; i <= secondsForHNSD; i++ {
+		if err = CheckHNSDVersion(); err == nil {
+			return nil
+		}
+		time.Sleep(1000 * time.Millisecond) //time hnsd needs to start running
+	}
+	return err
+}
+
+func GetRoots(ctx context.Context, pathToExecutable string, confPath string, pathToCheckpoint string) {
+	rootPath, pathToCheckpoint := prepareDirs(confPath, pathToCheckpoint)
 
 	ctx, cancel := context.WithCancel(ctx)
-	cmd := exec.CommandContext(ctx, pathToExecutable, "-n", dnsAddress, "-p", "4", "-r", "127.0.0.1:12345", "-t", "-x", pathToCheckpoint)
+	cmd := hnsdCommand(ctx, pathToExecutable, pathToCheckpoint)
 	defer cancel()
 	cmd.Stderr = os.Stderr
 	stdoutPipe, err := cmd.StdoutPipe()
@@ -130,16 +154,9 @@ func GetRoots(ctx context.Context, pathToExecutable string, confPath string, pat
 		log.Fatalf("Error starting command: %v", err)
 	}
 
-	time.Sleep(100 * time.Millisecond) //0.1 second should suffice for the most of the computers
-	for i := 1; i <= secondsForHNSD; i++ {
-		if err := CheckHNSDVersion(); err == nil {
-			break
-		}
-		if i == secondsForHNSD {
-			cancel()
-			log.Fatalf("hnsd version is not compatible with SANE or cannot be run properly: %v", err)
-		}
-		time.Sleep(1000 * time.Millisecond) //time hnsd needs to start running
+	if err := waitHNSD(); err != nil {
+		cancel()
+		log.Fatalf("hnsd version is not compatible with SANE or cannot be run properly: %v", err)
 	}
 
 	slidingWindow := make([]BlockInfo, 0, BlocksToStore)
@@ -179,69 +196,215 @@ func GetRoots(ctx context.Context, pathToExecutable string, confPath string, pat
 	parseAndWriteOutput(stdoutPipe, signalChannel, slidingWindow, rootPath)
 }
 
-func parseAndWriteOutput(stdoutPipe io.ReadCloser, signalChannel chan os.Signal, slidingWindow []BlockInfo, rootPath string) {
-	scanner := bufio.NewScanner(stdoutPipe)
-	re := regexp.MustCompile(`chain \((\d+)\): tree_root ([a-fA-F0-9]+) timestamp (\d+)`)
-	rejectRe := regexp.MustCompile(`chain \((\d+)\): +rejected:`)
+// RunHNSD syncs the tree roots like GetRoots, then keeps hnsd running with its
+// root server on RootServer until ctx is done, hnsd is restarted if it exits.
+// The stored roots are updated with every new block.
+func RunHNSD(ctx context.Context, pathToExecutable string, confPath string, pathToCheckpoint string) {
+	rootPath, pathToCheckpoint := prepareDirs(confPath, pathToCheckpoint)
 
-	var tempBlock *BlockInfo
+	synced := make(chan struct{})
+	go func() {
+		first := true
+		for {
+			err := serveHNSD(ctx, pathToExecutable, pathToCheckpoint, rootPath, func() {
+				if first {
+					first = false
+					close(synced)
+				}
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			if first {
+				log.Fatalf("hnsd version is not compatible with SANE or cannot be run properly: %v", err)
+			}
+			log.Printf("hnsd exited: %v, restarting", err)
+			time.Sleep(secondsForHNSD * time.Second)
+		}
+	}()
+
+	select {
+	case <-synced:
+	case <-ctx.Done():
+	}
+}
+
+// serveHNSD runs hnsd until it exits, onSynced is called once the
+// tree roots are synced and written.
+func serveHNSD(ctx context.Context, pathToExecutable, pathToCheckpoint, rootPath string, onSynced func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := hnsdCommand(ctx, pathToExecutable, pathToCheckpoint)
+	cmd.Stderr = os.Stderr
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		cancel()
+		cmd.Wait()
+	}()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdoutPipe)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := waitHNSD(); err != nil {
+		return err
+	}
 
+	synced := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-time.After(timeToNotify * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			if ok, err := checkIfSynced(); err != nil {
+				log.Printf("Error checking synchronization: %v", err)
+			} else if ok {
+				close(synced)
+				return
+			}
+		}
+	}()
+
+	w := &window{blocks: make([]BlockInfo, 0, BlocksToStore)}
+	isSynced := false
 	for {
 		select {
-		case <-signalChannel:
-			myjson, _ := json.Marshal(slidingWindow)
-			if err := os.WriteFile(rootPath, myjson, 0777); err != nil {
-				log.Fatal(err)
+		case line, ok := <-lines:
+			if !ok {
+				return errors.New("hnsd closed its output")
 			}
-			return
-		default:
-			for scanner.Scan() {
-				line := scanner.Text()
-
-				if rejectMatch := rejectRe.FindStringSubmatch(line); len(rejectMatch) >= 2 {
-					if tempBlock != nil {
-						tempBlock = nil // Discard the tempBlock as it has been rejected
-					}
-					continue
-				}
-
-				// Check for tree_root line
-				if match := re.FindStringSubmatch(line); len(match) >= 4 {
-					blockNumber, err := strconv.ParseUint(match[1], 10, 32)
-					if err != nil {
-						log.Printf("failed to parse block height: %v", err)
-						continue
-					}
-					timestamp, err := strconv.ParseUint(match[3], 10, 64)
-					if err != nil {
-						log.Printf("failed to parse timestamp: %v", err)
-						continue
-					}
-					treeRoot := match[2]
-
-					// if there's a tempBlock already, add it to the slidingWindow
-					if tempBlock != nil && !contains(slidingWindow, tempBlock.TreeRoot) {
-						slidingWindow = append(slidingWindow, *tempBlock)
-						if len(slidingWindow) > BlocksToStore {
-							slidingWindow = slidingWindow[1:]
-						}
-					}
-					tempBlock = &BlockInfo{
-						Height:    uint32(blockNumber),
-						Timestamp: timestamp,
-						TreeRoot:  treeRoot,
-					}
+			if w.parse(line) && isSynced {
+				if err := writeRoots(rootPath, w.snapshot()); err != nil {
+					log.Printf("Error writing tree roots: %v", err)
 				}
 			}
-			//add last block
-			if !scanner.Scan() && tempBlock != nil {
-				slidingWindow = append(slidingWindow, *tempBlock)
-				if len(slidingWindow) > BlocksToStore {
-					slidingWindow = slidingWindow[1:]
-				}
+		case <-synced:
+			isSynced = true
+			synced = nil
+			if err := writeRoots(rootPath, w.snapshot()); err != nil {
+				return err
 			}
-
+			log.Print("Successfully synced last tree roots, hnsd keeps running")
+			onSynced()
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
+}
+
+var (
+	treeRootRe = regexp.MustCompile(`chain \((\d+)\): tree_root ([a-fA-F0-9]+) timestamp (\d+)`)
+	rejectRe   = regexp.MustCompile(`chain \((\d+)\): +rejected:`)
+)
+
+// window holds the last tree roots seen in hnsd output.
+type window struct {
+	blocks []BlockInfo
+	// the last block, dropped if hnsd rejects it
+	pending *BlockInfo
+}
+
+// parse reads a line of hnsd output, it returns whether a block was added.
+func (w *window) parse(line string) bool {
+	if rejectRe.MatchString(line) {
+		w.pending = nil // Discard the pending block as it has been rejected
+		return false
+	}
+
+	// Check for tree_root line
+	match := treeRootRe.FindStringSubmatch(line)
+	if len(match) < 4 {
+		return false
+	}
+	blockNumber, err := strconv.ParseUint(match[1], 10, 32)
+	if err != nil {
+		log.Printf("failed to parse block height: %v", err)
+		return false
+	}
+	timestamp, err := strconv.ParseUint(match[3], 10, 64)
+	if err != nil {
+		log.Printf("failed to parse timestamp: %v", err)
+		return false
+	}
 
+	// if there's a pending block already, add it to the window
+	added := false
+	if w.pending != nil && !contains(w.blocks, w.pending.TreeRoot) {
+		w.add(*w.pending)
+		added = true
+	}
+	w.pending = &BlockInfo{
+		Height:    uint32(blockNumber),
+		Timestamp: timestamp,
+		TreeRoot:  match[2],
+	}
+	return added
+}
+
+func (w *window) add(b BlockInfo) {
+	w.blocks = append(w.blocks, b)
+	if len(w.blocks) > BlocksToStore {
+		w.blocks = w.blocks[1:]
+	}
+}
+
+// flush adds the pending block.
+func (w *window) flush() {
+	if w.pending != nil {
+		w.add(*w.pending)
+		w.pending = nil
+	}
+}
+
+// snapshot returns the blocks including the pending one.
+func (w *window) snapshot() []BlockInfo {
+	blocks := append([]BlockInfo(nil), w.blocks...)
+	if w.pending != nil && !contains(blocks, w.pending.TreeRoot) {
+		blocks = append(blocks, *w.pending)
+	}
+	if len(blocks) > BlocksToStore {
+		blocks = blocks[len(blocks)-BlocksToStore:]
+	}
+	return blocks
+}
+
+func writeRoots(rootPath string, blocks []BlockInfo) error {
+	myjson, err := json.Marshal(blocks)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(rootPath, myjson, 0777)
+}
+
+func parseAndWriteOutput(stdoutPipe io.ReadCloser, signalChannel chan os.Signal, slidingWindow []BlockInfo, rootPath string) {
+	w := &window{blocks: slidingWindow}
+	scanner := bufio.NewScanner(stdoutPipe)
+	for scanner.Scan() {
+		w.parse(scanner.Text())
+	}
+	//add last block
+	w.flush()
+
+	<-signalChannel
+	if err := writeRoots(rootPath, w.blocks); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -28,3 +28,8 @@ func ReadStoredRoots(filepath string) ([]BlockInfo, error) {
 
 	return roots, nil
 }
+
+// WriteStoredRoots stores roots to be read by ReadStoredRoots.
+func WriteStoredRoots(filepath string, roots []BlockInfo) error {
+	return writeRoots(filepath, roots)
+}
@@ -0,0 +1,87 @@
+package tld
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var current atomic.Value
+
+// Parse reads a tld list in the IANA format, one tld per line
+// and lines starting with # are comments.
+func Parse(r io.Reader) (map[string]struct{}, error) {
+	tlds := make(map[string]struct{})
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if !validLabel(line) {
+			return nil, fmt.Errorf("line %d: invalid tld %q", n, line)
+		}
+		tlds[line] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(tlds) == 0 {
+		return nil, errors.New("empty tld list")
+	}
+
+	return tlds, nil
+}
+
+// ReadFile parses the tld list stored at path.
+func ReadFile(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Set replaces the list returned by ICANN.
+func Set(tlds map[string]struct{}) {
+	current.Store(tlds)
+}
+
+// ICANN returns the ICANN tlds in use, NameConstraints unless
+// another list was set.
+func ICANN() map[string]struct{} {
+	if tlds, ok := current.Load().(map[string]struct{}); ok {
+		return tlds
+	}
+	return NameConstraints
+}
+
+// IsICANN checks if the tld of name is an ICANN tld.
+func IsICANN(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		name = name[i+1:]
+	}
+
+	_, ok := ICANN()[name]
+	return ok
+}
+
+func validLabel(l string) bool {
+	if len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package tld
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	list := "# Version 2025010100, Last Updated Wed Jan  1 07:07:01 2025 UTC\nCOM\nXN--P1AI\n\nnewtld\n"
+	tlds, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("Parse(): got %v, want no error", err)
+	}
+	for _, tld := range []string{"com", "xn--p1ai", "newtld"} {
+		if _, ok := tlds[tld]; !ok {
+			t.Errorf("Parse(): %s missing", tld)
+		}
+	}
+	if len(tlds) != 3 {
+		t.Errorf("Parse(): got %d tlds, want 3", len(tlds))
+	}
+
+	for _, bad := range []string{"", "# only a comment\n", "com\nfoo.bar\n", "-com\n"} {
+		if _, err := Parse(strings.NewReader(bad)); err == nil {
+			t.Errorf("Parse(%q): got nil, want error", bad)
+		}
+	}
+}
+
+func TestIsICANN(t *testing.T) {
+	defer Set(NameConstraints)
+
+	if !IsICANN("example.com.") || IsICANN("htools") {
+		t.Error("IsICANN(): embedded list not used")
+	}
+
+	Set(map[string]struct{}{"htools": {}})
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"htools", true},
+		{"www.HTOOLS.", true},
+		{"example.com", false},
+	}
+	for _, test := range tests {
+		if got := IsICANN(test.name); got != test.want {
+			t.Errorf("IsICANN(%q): got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package sane
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
@@ -21,11 +22,20 @@ func (t *tlsError) Error() string {
 	return t.err
 }
 
+// verification records how the upstream connection was verified.
+type verification struct {
+	cert  *x509.Certificate
+	tlsa  *dns.TLSA
+	proof *prove.Proof
+	tofu  bool
+}
+
 // newTLSConfig creates a new tls configuration capable of validating DANE.
-func newTLSConfig(host string, rrs []*dns.TLSA, nameCheck bool, roots []sync.BlockInfo, externalServices []string) *tls.Config {
+// If v is not nil it records the verification.
+func newTLSConfig(host string, rrs []*dns.TLSA, nameCheck bool, roots []sync.BlockInfo, externalServices []string, v *verification) *tls.Config {
 	return &tls.Config{
 		InsecureSkipVerify: true, // lgtm[go/disabled-certificate-check]
-		VerifyConnection:   verifyConnection(rrs, nameCheck, host, roots, externalServices),
+		VerifyConnection:   verifyConnection(rrs, nameCheck, host, roots, externalServices, v),
 		ServerName:         host,
 		MinVersion:         tls.VersionTLS12,
 		// Supported TLS 1.2 cipher suites
@@ -45,7 +55,7 @@ func newTLSConfig(host string, rrs []*dns.TLSA, nameCheck bool, roots []sync.Blo
 }
 
 // verifyConnection returns a function that verifies the given tls connection state using the host and rrs
-func verifyConnection(rrs []*dns.TLSA, nameCheck bool, host string, roots []sync.BlockInfo, externalServices []string) func(cs tls.ConnectionState) error {
+func verifyConnection(rrs []*dns.TLSA, nameCheck bool, host string, roots []sync.BlockInfo, externalServices []string, v *verification) func(cs tls.ConnectionState) error {
 	return func(cs tls.ConnectionState) error {
 		// the host can be ignored per RFC 7671. Not Before, Not After are ignored as well.
 		// https://tools.ietf.org/html/rfc7671
@@ -63,10 +73,14 @@ func verifyConnection(rrs []*dns.TLSA, nameCheck bool, host string, roots []sync
 				continue
 			}
 			if err := t.Verify(cs.PeerCertificates[0]); err == nil {
-				if err := prove.VerifyCertificateExtensions(roots, *cert, t, externalServices); err != nil {
+				proof, err := prove.VerifyCertificateProof(roots, *cert, host, t, externalServices)
+				if err != nil {
 					log.Print(err)
 					return err
 				}
+				if v != nil {
+					*v = verification{cert: cert, tlsa: t, proof: proof}
+				}
 				return nil
 			}
 		}
@@ -75,6 +89,27 @@ func verifyConnection(rrs []*dns.TLSA, nameCheck bool, host string, roots []sync
 	}
 }
 
+// newTOFUConfig creates a new tls configuration that verifies the upstream
+// public key against the pin store instead of TLSA records.
+func newTOFUConfig(host string, pins *PinStore, v *verification) *tls.Config {
+	c := newTLSConfig(host, nil, false, nil, nil, nil)
+	c.VerifyConnection = verifyPin(host, pins, v)
+	return c
+}
+
+// verifyPin returns a function that verifies the given tls connection state using the pinned key for host
+func verifyPin(host string, pins *PinStore, v *verification) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if err := pins.Check(host, cs.PeerCertificates[0].RawSubjectPublicKeyInfo); err != nil {
+			return &tlsError{err: fmt.Sprintf("tls: %v", err)}
+		}
+		if v != nil {
+			*v = verification{cert: cs.PeerCertificates[0], tofu: true}
+		}
+		return nil
+	}
+}
+
 // terminateTLSHandshake terminates the tls handshake with an internal error alert
 // this is slightly more descriptive to indicate a validation failure instead of promptly closing the connection
 func terminateTLSHandshake(conn net.Conn) {
@@ -72,7 +72,7 @@ A0EA1wQgxtVuzgpd9kKDQhheJGQyaQzcZwAR7k215Fi/h0UTLb0jwOB+YUqd3eTn
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			log.Print(test.rr)
-			c := newTLSConfig(test.host, test.rr, test.nameCheck, nil, nil)
+			c := newTLSConfig(test.host, test.rr, test.nameCheck, nil, nil, nil)
 			err := c.VerifyConnection(tls.ConnectionState{PeerCertificates: peerCerts})
 
 			if err != nil && test.valid {
@@ -2,6 +2,7 @@ package sane
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -18,6 +19,7 @@ import (
 	"github.com/randomlogin/sane/proxy"
 	"github.com/randomlogin/sane/resolver"
 	"github.com/randomlogin/sane/sync"
+	"github.com/randomlogin/sane/tld"
 )
 
 var (
@@ -30,7 +32,7 @@ const (
 
 type Config struct {
 	Certificate     *x509.Certificate
-	PrivateKey      interface{}
+	PrivateKey      crypto.Signer
 	Validity        time.Duration
 	Resolver        resolver.Resolver
 	Constraints     map[string]struct{}
@@ -39,6 +41,20 @@ type Config struct {
 	RootsPath       string
 	ExternalService []string
 
+	// CAChain is sent after minted certificates, defaults to Certificate.
+	CAChain []*x509.Certificate
+
+	// Pins enables trust on first use for handshake names
+	// without TLSA records, nil disables it.
+	Pins *PinStore
+
+	// ClientIdentities are presented to upstream servers
+	// requesting a client certificate.
+	ClientIdentities *ClientIdentities
+
+	// IssuanceLog if set records every minted certificate.
+	IssuanceLog *IssuanceLog
+
 	// For handling relative urls/non-proxy requests
 	ContentHandler http.Handler
 }
@@ -50,6 +66,8 @@ type tunneler struct {
 	ExternalService []string
 	nameChecks      bool
 	constraints     map[string]struct{}
+	pins            *PinStore
+	clientIDs       *ClientIdentities
 	logger
 }
 
@@ -76,7 +94,15 @@ func (h *tunneler) Tunnel(ctx context.Context, clientConn *proxy.Conn, network,
 		tlsa = []*dns.TLSA{}
 	}
 
-	if len(tlsa) == 0 {
+	tofu := len(tlsa) == 0 && h.tofuEnabled(addrs.Host)
+	// browsers reject certificates violating the CA name constraints,
+	// and tunneling as is would skip the dane or tofu check
+	if (len(tlsa) > 0 || tofu) && !permits(h.mitm.ca, addrs.Host) {
+		h.warnf("name is not permitted by the CA name constraints", http.StatusForbidden, addr)
+		clientConn.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if len(tlsa) == 0 && !tofu {
 		remote, err := h.dialer.dialAddrList(ctx, network, addrs)
 		if err != nil {
 			h.warnf("dial remote host failed: %v", http.StatusBadGateway, addr, err)
@@ -107,19 +133,34 @@ func (h *tunneler) Tunnel(ctx context.Context, clientConn *proxy.Conn, network,
 		return
 	}
 
-	roots, err := sync.ReadStoredRoots(h.RootsPath)
-	if err != nil {
-		log.Fatal(err)
+	var v verification
+	var remoteConfig *tls.Config
+	if tofu {
+		remoteConfig = newTOFUConfig(tlsaDomain, h.pins, &v)
+	} else {
+		roots, err := sync.ReadStoredRoots(h.RootsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the base domain is checked and sent upstream instead
+		// of the host it is an alias of (RFC 7671 section 7)
+		if addrs.Base != tlsaDomain {
+			h.logf("using tlsa base domain `%s`", http.StatusOK, addr, addrs.Base)
+		}
+		remoteConfig = newTLSConfig(addrs.Base, tlsa, h.nameChecks, roots, h.ExternalService, &v)
+	}
+
+	if h.clientIDs != nil {
+		remoteConfig.GetClientCertificate = h.clientIDs.getClientCertificate(tlsaDomain)
 	}
 
 	alpn := false
-	daneConfig := newTLSConfig(tlsaDomain, tlsa, h.nameChecks, roots, h.ExternalService)
 	if len(hello.SupportedProtos) > 0 {
-		daneConfig.NextProtos = hello.SupportedProtos
+		remoteConfig.NextProtos = hello.SupportedProtos
 		alpn = true
 	}
 
-	remote, err := h.dialer.dialTLSContext(ctx, network, addrs, daneConfig)
+	remote, err := h.dialer.dialTLSContext(ctx, network, addrs, remoteConfig)
 	if _, ok := err.(*tlsError); ok {
 		terminateTLSHandshake(clientConn)
 	}
@@ -131,7 +172,7 @@ func (h *tunneler) Tunnel(ctx context.Context, clientConn *proxy.Conn, network,
 
 	// create certificate & negotiate the same protocol
 	// used by the remote server
-	clientTLSConfig := h.mitm.configForTLSADomain(tlsaDomain)
+	clientTLSConfig := h.mitm.configForTLSADomain(tlsaDomain, &v)
 	if alpn {
 		if serverProto := remote.ConnectionState().NegotiatedProtocol; serverProto != "" {
 			clientTLSConfig.NextProtos = []string{serverProto}
@@ -148,10 +189,23 @@ func (h *tunneler) Tunnel(ctx context.Context, clientConn *proxy.Conn, network,
 		return
 	}
 
-	h.logf("dane tunnel established %s", http.StatusOK, addr, remote.RemoteAddr().String())
+	if tofu {
+		h.logf("tofu tunnel established %s", http.StatusOK, addr, remote.RemoteAddr().String())
+	} else {
+		h.logf("dane tunnel established %s", http.StatusOK, addr, remote.RemoteAddr().String())
+	}
 	copyConn(clientTLS, remote)
 }
 
+// tofuEnabled checks if trust on first use applies to host.
+// ICANN names and ip addresses are always tunneled as is.
+func (h *tunneler) tofuEnabled(host string) bool {
+	if h.pins == nil || net.ParseIP(host) != nil {
+		return false
+	}
+	return !tld.IsICANN(host)
+}
+
 func (c *Config) NewHandler() (*proxy.Handler, error) {
 	p := &proxy.Handler{}
 
@@ -159,6 +213,13 @@ func (c *Config) NewHandler() (*proxy.Handler, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(c.CAChain) > 0 {
+		mitm.chain = nil
+		for _, cert := range c.CAChain {
+			mitm.chain = append(mitm.chain, cert.Raw)
+		}
+	}
+	mitm.issuances = c.IssuanceLog
 
 	dialer := newDialer()
 	dialer.resolver = c.Resolver
@@ -172,6 +233,8 @@ func (c *Config) NewHandler() (*proxy.Handler, error) {
 			verbose: c.Verbose,
 		},
 		constraints:     c.Constraints,
+		pins:            c.Pins,
+		clientIDs:       c.ClientIdentities,
 		RootsPath:       c.RootsPath,
 		ExternalService: c.ExternalService,
 	}
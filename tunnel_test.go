@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/randomlogin/sane/resolver"
 )
 
 func newProxyTestConfig(t *testing.T) (*x509.Certificate, *Config) {
@@ -459,8 +460,10 @@ func (rt roundTripperTestFunc) RoundTrip(r *http.Request) (*http.Response, error
 }
 
 type testResolver struct {
-	lookupIP   func(ctx context.Context, network, host string) ([]net.IP, bool, error)
-	lookupTLSA func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error)
+	lookupIP    func(ctx context.Context, network, host string) ([]net.IP, bool, error)
+	lookupTLSA  func(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error)
+	lookupHTTPS func(ctx context.Context, name string) ([]*dns.HTTPS, bool, error)
+	lookupCNAME func(ctx context.Context, host string) (string, bool, error)
 }
 
 func (t testResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, bool, error) {
@@ -470,3 +473,25 @@ func (t testResolver) LookupIP(ctx context.Context, network, host string) ([]net
 func (t testResolver) LookupTLSA(ctx context.Context, service, proto, name string) ([]*dns.TLSA, bool, error) {
 	return t.lookupTLSA(ctx, service, proto, name)
 }
+
+func (t testResolver) LookupSVCB(ctx context.Context, name string) ([]*dns.SVCB, bool, error) {
+	return nil, false, nil
+}
+
+func (t testResolver) LookupHTTPS(ctx context.Context, name string) ([]*dns.HTTPS, bool, error) {
+	if t.lookupHTTPS == nil {
+		return nil, false, nil
+	}
+	return t.lookupHTTPS(ctx, name)
+}
+
+func (t testResolver) LookupCNAME(ctx context.Context, host string) (string, bool, error) {
+	if t.lookupCNAME == nil {
+		return dns.Fqdn(host), false, nil
+	}
+	return t.lookupCNAME(ctx, host)
+}
+
+func (t testResolver) Lookup(ctx context.Context, name string, qtype uint16) *resolver.DNSResult {
+	return &resolver.DNSResult{}
+}